@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/tcfw/minidns/plugins"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+//batchReadWriter is implemented by both ipv4.PacketConn and ipv6.PacketConn as
+//their Message types are aliases of the same type
+type batchReadWriter interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+//messagePool pools batches of messages with datagram sized buffers for reading
+//and variable sized buffers for outgoing datagrams
+type messagePool struct {
+	batchSize int
+	batches   sync.Pool
+	buffers   sync.Pool
+}
+
+func newMessagePool(batchSize int) *messagePool {
+	mp := &messagePool{batchSize: batchSize}
+
+	mp.batches.New = func() interface{} {
+		batch := make([]ipv4.Message, batchSize)
+		for i := range batch {
+			batch[i].Buffers = [][]byte{make([]byte, plugins.MaxUDPSize)}
+		}
+		return &batch
+	}
+
+	mp.buffers.New = func() interface{} {
+		b := make([]byte, 0, plugins.MinUDPSize)
+		return &b
+	}
+
+	return mp
+}
+
+//getBatch gets a batch of messages for reading into
+func (mp *messagePool) getBatch() *[]ipv4.Message {
+	return mp.batches.Get().(*[]ipv4.Message)
+}
+
+//putBatch returns a batch, resetting the buffers to their full size
+func (mp *messagePool) putBatch(batch *[]ipv4.Message) {
+	for i := range *batch {
+		msg := &(*batch)[i]
+		msg.Buffers[0] = msg.Buffers[0][:cap(msg.Buffers[0])]
+		msg.Addr = nil
+		msg.N = 0
+	}
+	mp.batches.Put(batch)
+}
+
+//copyBuffer copies the datagram into a pooled buffer
+func (mp *messagePool) copyBuffer(b []byte) *[]byte {
+	buf := mp.buffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], b...)
+	return buf
+}
+
+func (mp *messagePool) putBuffer(buf *[]byte) {
+	mp.buffers.Put(buf)
+}
+
+type outgoingDatagram struct {
+	buf  *[]byte
+	addr net.Addr
+}
+
+//batchPacketConn wraps a UDP conn to read and write many datagrams per syscall
+//using recvmmsg/sendmmsg where supported. Writes are queued and sent by a single
+//writer goroutine, so WriteTo never blocks on the socket
+type batchPacketConn struct {
+	net.PacketConn
+
+	rw   batchReadWriter
+	pool *messagePool
+
+	//closeMu stops datagrams being queued once closed, so all queued datagrams
+	//are sent before the conn is closed
+	closeMu   sync.RWMutex
+	closed    bool
+	out       chan outgoingDatagram
+	done      chan struct{}
+	flushed   chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatchPacketConn(conn net.PacketConn, batchSize int) *batchPacketConn {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var rw batchReadWriter = ipv4.NewPacketConn(conn)
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len {
+		rw = ipv6.NewPacketConn(conn)
+	}
+
+	bc := &batchPacketConn{
+		PacketConn: conn,
+		rw:         rw,
+		pool:       newMessagePool(batchSize),
+		out:        make(chan outgoingDatagram, batchSize*4),
+		done:       make(chan struct{}),
+		flushed:    make(chan struct{}),
+	}
+
+	go bc.writeLoop()
+
+	return bc
+}
+
+//ReadBatch reads up to a batch of datagrams. The batch must be returned with
+//ReleaseBatch once the datagrams have been processed
+func (bc *batchPacketConn) ReadBatch() (*[]ipv4.Message, int, error) {
+	batch := bc.pool.getBatch()
+
+	n, err := bc.rw.ReadBatch(*batch, 0)
+	if err != nil {
+		bc.pool.putBatch(batch)
+		return nil, 0, err
+	}
+
+	return batch, n, nil
+}
+
+//ReleaseBatch returns a batch from ReadBatch to the pool
+func (bc *batchPacketConn) ReleaseBatch(batch *[]ipv4.Message) {
+	bc.pool.putBatch(batch)
+}
+
+//WriteTo queues the datagram to be sent in the next batch
+func (bc *batchPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	bc.closeMu.RLock()
+	defer bc.closeMu.RUnlock()
+
+	if bc.closed {
+		return 0, net.ErrClosed
+	}
+
+	bc.out <- outgoingDatagram{buf: bc.pool.copyBuffer(b), addr: addr}
+
+	return len(b), nil
+}
+
+//Close stops the writer once the queued datagrams have been sent and closes the
+//underlying conn
+func (bc *batchPacketConn) Close() error {
+	bc.closeOnce.Do(func() {
+		bc.closeMu.Lock()
+		bc.closed = true
+		close(bc.done)
+		bc.closeMu.Unlock()
+
+		<-bc.flushed
+	})
+
+	return bc.PacketConn.Close()
+}
+
+//writeLoop sends queued datagrams, batching together as many as are waiting,
+//until closed and all queued datagrams have been sent
+func (bc *batchPacketConn) writeLoop() {
+	defer close(bc.flushed)
+
+	pending := make([]outgoingDatagram, 0, bc.pool.batchSize)
+	batch := make([]ipv4.Message, bc.pool.batchSize)
+	for i := range batch {
+		batch[i].Buffers = make([][]byte, 1)
+	}
+
+	for {
+		select {
+		case d := <-bc.out:
+			pending = append(pending, d)
+		case <-bc.done:
+			//No more datagrams can be queued once closed
+			select {
+			case d := <-bc.out:
+				pending = append(pending, d)
+			default:
+				return
+			}
+		}
+
+	fill:
+		for len(pending) < cap(pending) {
+			select {
+			case d := <-bc.out:
+				pending = append(pending, d)
+			default:
+				break fill
+			}
+		}
+
+		for i, d := range pending {
+			batch[i].Buffers[0] = *d.buf
+			batch[i].Addr = d.addr
+		}
+
+		bc.writeBatch(batch[:len(pending)])
+
+		for i, d := range pending {
+			bc.pool.putBuffer(d.buf)
+			batch[i].Buffers[0] = nil
+			batch[i].Addr = nil
+		}
+		pending = pending[:0]
+	}
+}
+
+//writeBatch writes all messages, skipping over any individual datagram which fails
+func (bc *batchPacketConn) writeBatch(msgs []ipv4.Message) {
+	for len(msgs) > 0 {
+		n, err := bc.rw.WriteBatch(msgs, 0)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			//The datagram after those written failed
+			n++
+		}
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+
+		msgs = msgs[n:]
+	}
+}
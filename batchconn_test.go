@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatchPacketConnFlushesOnClose(t *testing.T) {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := newBatchPacketConn(conn, 8)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		if _, err := bc.WriteTo([]byte{byte(i)}, client.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc.Close()
+
+	if _, err := bc.WriteTo([]byte{0}, client.LocalAddr()); err == nil {
+		t.Error("WriteTo() succeeded after Close()")
+	}
+
+	buf := make([]byte, 16)
+	for i := 0; i < n; i++ {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := client.ReadFrom(buf); err != nil {
+			t.Fatalf("received %d of %d datagrams queued before Close(): %s", i, n, err)
+		}
+	}
+}
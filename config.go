@@ -14,12 +14,46 @@ func init() {
 	viper.SetDefault("port", 53)
 	viper.SetDefault("http_port", 80)
 
+	viper.SetDefault("udp_sockets", 1)
+	viper.SetDefault("udp_batch_size", 16)
+	viper.SetDefault("udp_workers", 1000)
+	viper.SetDefault("udp_queue_size", 10000)
+	viper.SetDefault("overload_policy", "drop")
+
+	viper.SetDefault("edns_udp_size", 1232)
+
+	viper.SetDefault("user", "")
+	viper.SetDefault("group", "")
+	viper.SetDefault("chroot", "")
+
+	viper.SetDefault("shutdown_timeout", 10)
+	viper.SetDefault("upgrade_timeout", 300)
+
+	viper.SetDefault("tcp_idle_timeout", 10)
+	viper.SetDefault("tcp_max_conns", 1000)
+
+	viper.SetDefault("dot_port", 853)
+	viper.SetDefault("doq_port", 853)
+	viper.SetDefault("tls_cert", "")
+	viper.SetDefault("tls_key", "")
+
+	viper.SetDefault("dnscrypt_provider_name", "2.dnscrypt-cert.minidns")
+	viper.SetDefault("dnscrypt_key", "dnscrypt.key")
+	viper.SetDefault("dnscrypt_cert_ttl", 24)
+
+	viper.SetDefault("doh_tls", false)
+	viper.SetDefault("https_port", 443)
+
 	viper.SetDefault("disabled_plugins", []string{"doh_forwarders"})
 
 	viper.SetDefault("use_internal_resolver", false)
 
 	viper.SetDefault("forwarders", []string{"1.1.1.1", "1.0.0.1"})
 	viper.SetDefault("doh_forwarders", []string{"dns.google"})
+	viper.SetDefault("upstream_strategy", "sequential")
+	viper.SetDefault("upstream_parallel", 2)
+	viper.SetDefault("upstream_max_fails", 3)
+	viper.SetDefault("upstream_probe_interval", 10)
 
 	viper.SetDefault("blacklist", []string{})
 	viper.SetDefault("blocklists", []string{
@@ -72,6 +106,21 @@ func init() {
 	viper.SetEnvPrefix("minidns")
 	viper.AutomaticEnv()
 
+	viper.SetConfigName("minidns")
+	viper.AddConfigPath("/etc/minidns")
+	viper.AddConfigPath(".")
+	if cfgFile := viper.GetString("config"); cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			log.Fatalf("Failed to read config: %s", err)
+		}
+	} else {
+		log.Printf("Using config file %s", viper.ConfigFileUsed())
+	}
+
 	log.Println("Read config")
 	log.Printf("Disabled plugins: %v", viper.GetStringSlice("disabled_plugins"))
 	viper.SetDefault("ready", true)
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tcfw/minidns/dnscrypt"
+	"github.com/tcfw/minidns/metrics"
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dnscryptCert a short-term resolver certificate and its key pair
+type dnscryptCert struct {
+	esVersion   uint16
+	serial      uint32
+	publicKey   [32]byte
+	secretKey   [32]byte
+	clientMagic [dnscrypt.ClientMagicLen]byte
+	notAfter    time.Time
+
+	//encoded the signed certificate as served in the TXT record
+	encoded []byte
+}
+
+//dnscryptSession the keys to encrypt the response to a decrypted query
+type dnscryptSession struct {
+	cert        *dnscryptCert
+	sharedKey   [32]byte
+	clientNonce [dnscrypt.HalfNonceLen]byte
+}
+
+//dnscryptServer serves DNSCrypt v2 queries, signing short-term certificates with
+//the long-term provider key and rotating them before they expire
+type dnscryptServer struct {
+	providerName string
+	providerKey  ed25519.PrivateKey
+	certTTL      time.Duration
+
+	mu    sync.RWMutex
+	certs []*dnscryptCert
+}
+
+func newDNSCryptServer(providerName string, keyFile string, certTTL time.Duration) (*dnscryptServer, error) {
+	key, err := loadDNSCryptKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &dnscryptServer{
+		providerName: strings.TrimSuffix(providerName, "."),
+		providerKey:  key,
+		certTTL:      certTTL,
+	}
+
+	if err := ds.rotate(); err != nil {
+		return nil, err
+	}
+
+	go ds.rotateCerts()
+
+	return ds, nil
+}
+
+//loadDNSCryptKey reads the hex encoded Ed25519 provider key, generating a new key
+//if the file doesn't exist yet
+func loadDNSCryptKey(keyFile string) (ed25519.PrivateKey, error) {
+	data, err := readKeyFile(keyFile)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		data := []byte(hex.EncodeToString(key) + "\n")
+		if err := ioutil.WriteFile(keyFile, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save DNSCrypt provider key: %s", err)
+		}
+		rememberKeyFile(keyFile, data)
+
+		log.Printf("Generated DNSCrypt provider key %s", keyFile)
+
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNSCrypt provider key: %s", err)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	default:
+		return nil, fmt.Errorf("invalid DNSCrypt provider key length %d", len(raw))
+	}
+}
+
+//rotateCerts issues new certificates half way through the lifetime of the
+//current ones so clients always find a valid certificate
+func (ds *dnscryptServer) rotateCerts() {
+	ticker := time.NewTicker(ds.certTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := ds.rotate(); err != nil {
+			log.Printf("failed to rotate DNSCrypt certificates: %s\n", err)
+		}
+	}
+}
+
+//rotate issues a certificate for each encryption system and removes expired ones
+func (ds *dnscryptServer) rotate() error {
+	now := time.Now()
+
+	certs := []*dnscryptCert{}
+	for _, es := range []uint16{dnscrypt.XChacha20Poly1305, dnscrypt.XSalsa20Poly1305} {
+		cert, err := ds.newCert(es, now)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for _, cert := range ds.certs {
+		if now.Before(cert.notAfter) {
+			certs = append(certs, cert)
+		}
+	}
+	ds.certs = certs
+
+	return nil
+}
+
+func (ds *dnscryptServer) newCert(es uint16, now time.Time) (*dnscryptCert, error) {
+	cert := &dnscryptCert{
+		esVersion: es,
+		serial:    uint32(now.Unix()),
+		notAfter:  now.Add(ds.certTTL),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, cert.secretKey[:]); err != nil {
+		return nil, err
+	}
+
+	pk, err := curve25519.X25519(cert.secretKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(cert.publicKey[:], pk)
+	copy(cert.clientMagic[:], pk)
+
+	signed := make([]byte, 0, 52)
+	signed = append(signed, cert.publicKey[:]...)
+	signed = append(signed, cert.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, cert.serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(now.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(cert.notAfter.Unix()))
+
+	cert.encoded = append([]byte(dnscrypt.CertMagic), 0, byte(es), 0, 0)
+	cert.encoded = append(cert.encoded, ed25519.Sign(ds.providerKey, signed)...)
+	cert.encoded = append(cert.encoded, signed...)
+
+	return cert, nil
+}
+
+//certForQuery finds the certificate with the client magic the query starts with
+func (ds *dnscryptServer) certForQuery(packet []byte) *dnscryptCert {
+	if len(packet) < dnscrypt.QueryOverhead {
+		return nil
+	}
+
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	for _, cert := range ds.certs {
+		if bytes.Equal(packet[:dnscrypt.ClientMagicLen], cert.clientMagic[:]) {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+//stamp the sdns:// stamp clients use to find and authenticate the resolver
+func (ds *dnscryptServer) stamp(addr string) string {
+	//Protocol 0x01 (DNSCrypt) followed by the properties, which are all unset
+	stamp := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	addr = strings.TrimSuffix(addr, ":443")
+	pk := ds.providerKey.Public().(ed25519.PublicKey)
+
+	for _, v := range [][]byte{[]byte(addr), pk, []byte(ds.providerName)} {
+		stamp = append(stamp, byte(len(v)))
+		stamp = append(stamp, v...)
+	}
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(stamp)
+}
+
+//handle processes a DNSCrypt packet returning the packet to send back, or nil if
+//the packet should be ignored
+func (ds *dnscryptServer) handle(pipeline *plugins.Pipeline, addr net.Addr, packet []byte, udp bool) []byte {
+	return ds.respond(addr, packet, udp, func(req *dnsmessage.Message) []byte {
+		return handleRequest(pipeline, nil, addr, req)
+	})
+}
+
+//reject responds to a DNSCrypt over UDP query with the rcode without running the
+//plugin chain
+func (ds *dnscryptServer) reject(addr net.Addr, packet []byte, rcode dnsmessage.RCode) []byte {
+	return ds.respond(addr, packet, true, func(req *dnsmessage.Message) []byte {
+		return rejectResponse(req, rcode)
+	})
+}
+
+//respond decrypts the query, encrypting the response from answer. Plain DNS
+//queries are only answered for the certificate TXT record. UDP responses can't
+//be larger than the query
+func (ds *dnscryptServer) respond(addr net.Addr, packet []byte, udp bool, answer func(req *dnsmessage.Message) []byte) []byte {
+	cert := ds.certForQuery(packet)
+	if cert == nil {
+		return ds.handleCertQuery(packet)
+	}
+
+	query, session, err := ds.decrypt(cert, packet)
+	if err != nil {
+		if shouldLogVerbose() {
+			log.Printf("failed to decrypt DNSCrypt query from %s: %s\n", addr, err)
+		}
+		return nil
+	}
+
+	req := &dnsmessage.Message{}
+	if err := req.Unpack(query); err != nil || req.Header.Response {
+		return nil
+	}
+
+	maxLen := plugins.MaxUDPSize - dnscrypt.ResponseOverhead
+	if udp {
+		maxLen = len(packet) - dnscrypt.ResponseOverhead
+	}
+
+	resp := answer(req)
+	if resp == nil {
+		return nil
+	}
+
+	//At least one byte of padding is needed
+	if len(resp) > maxLen-1 {
+		resp, err = truncate(req, maxLen-1)
+		if err != nil || len(resp) > maxLen-1 {
+			resp = truncatedHeader(req)
+		}
+		metrics.IncRequests("truncated")
+	}
+
+	return ds.encrypt(session, resp, maxLen)
+}
+
+//decrypt opens the query using the shared key of the certificate and the client key
+func (ds *dnscryptServer) decrypt(cert *dnscryptCert, packet []byte) ([]byte, *dnscryptSession, error) {
+	session := &dnscryptSession{cert: cert}
+
+	var clientPK [32]byte
+	copy(clientPK[:], packet[dnscrypt.ClientMagicLen:])
+	copy(session.clientNonce[:], packet[dnscrypt.ClientMagicLen+32:])
+
+	var err error
+	session.sharedKey, err = dnscrypt.SharedKey(cert.esVersion, &cert.secretKey, &clientPK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//The second half of the query nonce is zero
+	var nonce [24]byte
+	copy(nonce[:], session.clientNonce[:])
+
+	padded, err := dnscrypt.Open(cert.esVersion, &session.sharedKey, &nonce, packet[dnscrypt.ClientMagicLen+32+dnscrypt.HalfNonceLen:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query, err := dnscrypt.Unpad(padded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return query, session, nil
+}
+
+//encrypt seals the response so the full packet is no longer than maxLen plus overhead
+func (ds *dnscryptServer) encrypt(session *dnscryptSession, resp []byte, maxLen int) []byte {
+	var nonce [24]byte
+	copy(nonce[:], session.clientNonce[:])
+	if _, err := io.ReadFull(rand.Reader, nonce[dnscrypt.HalfNonceLen:]); err != nil {
+		return nil
+	}
+
+	packet := append([]byte(dnscrypt.ResolverMagic), nonce[:]...)
+	packet = append(packet, dnscrypt.Seal(session.cert.esVersion, &session.sharedKey, &nonce, dnscrypt.Pad(resp, maxLen))...)
+
+	return packet
+}
+
+//handleCertQuery answers an unencrypted TXT query for the provider name with the
+//current certificates
+func (ds *dnscryptServer) handleCertQuery(packet []byte) []byte {
+	req := &dnsmessage.Message{}
+	if err := req.Unpack(packet); err != nil || req.Header.Response || len(req.Questions) != 1 {
+		return nil
+	}
+
+	q := req.Questions[0]
+	if q.Type != dnsmessage.TypeTXT || !strings.EqualFold(strings.TrimSuffix(q.Name.String(), "."), ds.providerName) {
+		return nil
+	}
+
+	ds.mu.RLock()
+	certs := ds.certs
+	ds.mu.RUnlock()
+
+	req.Header.Response = true
+	req.Header.Authoritative = true
+	req.Additionals = nil
+
+	for _, cert := range certs {
+		ttl := time.Until(cert.notAfter)
+		if ttl <= 0 {
+			continue
+		}
+
+		req.Answers = append(req.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: uint32(ttl.Seconds())},
+			Body:   &dnsmessage.TXTResource{TXT: []string{string(cert.encoded)}},
+		})
+	}
+
+	bytes, err := req.Pack()
+	if err != nil {
+		log.Printf("failed to pack DNSCrypt certificate response: %s\n", err)
+		return nil
+	}
+
+	return bytes
+}
+
+//listenForDNSCryptUDP reads DNSCrypt queries from the packet conn, handing them
+//to the UDP workers
+func listenForDNSCryptUDP(pconn net.PacketConn, ds *dnscryptServer, pool *workerPool, pipeline *plugins.Pipeline) error {
+	buf := make([]byte, plugins.MaxUDPSize)
+
+	for {
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("failed to read DNSCrypt request: %s\n", err)
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		//While handing off to a new process the socket is shared, so queries
+		//read here are still answered rather than dropped
+		tracked := startRequest()
+		if !tracked && atomic.LoadInt32(&handingOff) == 0 {
+			continue
+		}
+
+		pool.submit(udpJob{pipeline: pipeline, conn: pconn, addr: addr, dnscrypt: ds, packet: packet, tracked: tracked})
+	}
+}
+
+//listenForDNSCryptTCP accepts DNSCrypt over TCP connections limiting the number
+//of concurrent connections to tcp_max_conns
+func listenForDNSCryptTCP(ln net.Listener, ds *dnscryptServer, pipeline *plugins.Pipeline) error {
+	return acceptTCPConns(ln, func(c net.Conn) {
+		handleDNSCryptTCPConn(c, ds, pipeline)
+	})
+}
+
+//handleDNSCryptTCPConn handles queries in order until the client closes the
+//connection, it is idle for longer than tcp_idle_timeout or a query is invalid
+func handleDNSCryptTCPConn(c net.Conn, ds *dnscryptServer, pipeline *plugins.Pipeline) {
+	idleTimeout := time.Duration(viper.GetInt("tcp_idle_timeout")) * time.Second
+
+	tcpConns.Store(c, true)
+
+	defer func() {
+		c.Close()
+		tcpConns.Delete(c)
+	}()
+
+	for {
+		c.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		packet, err := plugins.ReadTCPFrame(c)
+		if err != nil {
+			return
+		}
+
+		if !startRequest() {
+			return
+		}
+
+		resp := ds.handle(pipeline, c.RemoteAddr(), packet, false)
+		finishRequest()
+
+		if resp == nil {
+			return
+		}
+
+		c.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if err := plugins.WriteTCPMessage(c, resp); err != nil {
+			log.Printf("failed to write DNSCrypt response: %s\n", err)
+			return
+		}
+	}
+}
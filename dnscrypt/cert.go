@@ -0,0 +1,49 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+//certLen length of a certificate with the magic, versions, signature and signed fields
+const certLen = 124
+
+//Cert a short-term resolver certificate as served in the provider's TXT record
+type Cert struct {
+	ES          uint16
+	PublicKey   [32]byte
+	ClientMagic [ClientMagicLen]byte
+	Serial      uint32
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+//ParseCert decodes the certificate, checking it was signed by the provider key
+func ParseCert(b []byte, providerKey ed25519.PublicKey) (*Cert, error) {
+	if len(b) != certLen || string(b[:4]) != CertMagic {
+		return nil, fmt.Errorf("invalid DNSCrypt certificate")
+	}
+
+	sig, signed := b[8:72], b[72:]
+	if !ed25519.Verify(providerKey, signed, sig) {
+		return nil, fmt.Errorf("invalid DNSCrypt certificate signature")
+	}
+
+	cert := &Cert{
+		ES:        binary.BigEndian.Uint16(b[4:6]),
+		Serial:    binary.BigEndian.Uint32(signed[40:44]),
+		NotBefore: time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0),
+		NotAfter:  time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0),
+	}
+	copy(cert.PublicKey[:], signed[:32])
+	copy(cert.ClientMagic[:], signed[32:40])
+
+	return cert, nil
+}
+
+//Valid checks the certificate can be used at the given time
+func (c *Cert) Valid(now time.Time) bool {
+	return !now.Before(c.NotBefore) && now.Before(c.NotAfter)
+}
@@ -0,0 +1,86 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+//testCert a certificate for the resolver key of the crypto vectors, signed with
+//libsodium's crypto_sign_detached by the provider key with seed 0x32..0x51
+const (
+	testProviderKey = "5e423033044f56a13a686799487bcbfa63dd1e39204cec27dd39a26daa615628"
+	testCert        = "444e5343000200001012bc5d29a938705af47646e6272a42f9f23326ec3b6fe48adf6ba1254c618ebb97dc80af5bb2497f12c26a35b3fa3ecc14e8e0eb737bd0d0548e1d735f7f0d07a37cbc142093c8b755dc1b10e86cb426374ad16aa853ed0bdfc0b2b86d1c7c444e5343747374310000002a6553f10065554280"
+)
+
+func TestParseCert(t *testing.T) {
+	providerKey := ed25519.PublicKey(fromHex(t, testProviderKey))
+
+	cert, err := ParseCert(fromHex(t, testCert), providerKey)
+	if err != nil {
+		t.Fatalf("ParseCert() error = %v", err)
+	}
+
+	if cert.ES != XChacha20Poly1305 {
+		t.Errorf("ES = %d, want %d", cert.ES, XChacha20Poly1305)
+	}
+	if cert.PublicKey != *key32(t, testResolverPublicKey) {
+		t.Errorf("PublicKey = %x, want %s", cert.PublicKey, testResolverPublicKey)
+	}
+	if string(cert.ClientMagic[:]) != "DNSCtst1" {
+		t.Errorf("ClientMagic = %q, want DNSCtst1", cert.ClientMagic)
+	}
+	if cert.Serial != 42 {
+		t.Errorf("Serial = %d, want 42", cert.Serial)
+	}
+	if !cert.NotBefore.Equal(time.Unix(1700000000, 0)) || !cert.NotAfter.Equal(time.Unix(1700086400, 0)) {
+		t.Errorf("validity = %s to %s, want %s to %s", cert.NotBefore, cert.NotAfter, time.Unix(1700000000, 0), time.Unix(1700086400, 0))
+	}
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		valid bool
+	}{
+		{"before", time.Unix(1699999999, 0), false},
+		{"start", time.Unix(1700000000, 0), true},
+		{"during", time.Unix(1700050000, 0), true},
+		{"end", time.Unix(1700086400, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := cert.Valid(tt.now); got != tt.valid {
+			t.Errorf("Valid(%s) = %t, want %t", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestParseCertInvalid(t *testing.T) {
+	providerKey := ed25519.PublicKey(fromHex(t, testProviderKey))
+	otherKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+	tampered := fromHex(t, testCert)
+	tampered[len(tampered)-1] ^= 1
+
+	badMagic := fromHex(t, testCert)
+	badMagic[0] = 'X'
+
+	tests := []struct {
+		name string
+		cert []byte
+		key  ed25519.PublicKey
+	}{
+		{"short", fromHex(t, testCert)[:100], providerKey},
+		{"magic", badMagic, providerKey},
+		{"tampered", tampered, providerKey},
+		{"other provider", fromHex(t, testCert), otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCert(tt.cert, tt.key); err == nil {
+				t.Error("ParseCert() accepted an invalid certificate")
+			}
+		})
+	}
+}
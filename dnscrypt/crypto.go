@@ -0,0 +1,157 @@
+//Package dnscrypt implements the encryption used by the DNSCrypt v2 protocol,
+//shared by the DNSCrypt listener and upstreams
+package dnscrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+//Encryption systems
+const (
+	XSalsa20Poly1305  uint16 = 1
+	XChacha20Poly1305 uint16 = 2
+)
+
+const (
+	CertMagic     = "DNSC"
+	ResolverMagic = "r6fnvWj8"
+
+	ClientMagicLen = 8
+	HalfNonceLen   = 12
+	TagLen         = 16
+
+	//QueryOverhead client magic, client public key, half nonce and tag
+	QueryOverhead = ClientMagicLen + 32 + HalfNonceLen + TagLen
+
+	//ResponseOverhead resolver magic, full nonce and tag
+	ResponseOverhead = len(ResolverMagic) + 2*HalfNonceLen + TagLen
+
+	paddingBlock = 64
+)
+
+var errDecrypt = errors.New("failed to decrypt DNSCrypt message")
+
+//SharedKey computes the crypto_box shared key between the resolver and
+//client keys for the encryption system
+func SharedKey(es uint16, secretKey, publicKey *[32]byte) ([32]byte, error) {
+	var shared [32]byte
+
+	switch es {
+	case XSalsa20Poly1305:
+		box.Precompute(&shared, publicKey, secretKey)
+	case XChacha20Poly1305:
+		dh, err := curve25519.X25519(secretKey[:], publicKey[:])
+		if err != nil {
+			return shared, err
+		}
+
+		key, err := chacha20.HChaCha20(dh, make([]byte, 16))
+		if err != nil {
+			return shared, err
+		}
+		copy(shared[:], key)
+	default:
+		return shared, fmt.Errorf("unsupported encryption system %d", es)
+	}
+
+	return shared, nil
+}
+
+//Seal encrypts and authenticates the message, returning the tag followed
+//by the ciphertext as in crypto_box_easy
+func Seal(es uint16, key *[32]byte, nonce *[24]byte, msg []byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+
+	out := make([]byte, TagLen+len(msg))
+
+	polyKey, stream := xchachaStream(key, nonce)
+	stream.XORKeyStream(out[TagLen:], msg)
+
+	var tag [TagLen]byte
+	poly1305.Sum(&tag, out[TagLen:], &polyKey)
+	copy(out, tag[:])
+
+	return out
+}
+
+//Open authenticates and decrypts a message sealed with Seal
+func Open(es uint16, key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < TagLen {
+		return nil, errDecrypt
+	}
+
+	if es == XSalsa20Poly1305 {
+		msg, ok := secretbox.Open(nil, sealed, nonce, key)
+		if !ok {
+			return nil, errDecrypt
+		}
+		return msg, nil
+	}
+
+	polyKey, stream := xchachaStream(key, nonce)
+
+	var tag [TagLen]byte
+	poly1305.Sum(&tag, sealed[TagLen:], &polyKey)
+	if subtle.ConstantTimeCompare(tag[:], sealed[:TagLen]) != 1 {
+		return nil, errDecrypt
+	}
+
+	msg := make([]byte, len(sealed)-TagLen)
+	stream.XORKeyStream(msg, sealed[TagLen:])
+
+	return msg, nil
+}
+
+//xchachaStream the XChaCha20 keystream as used by crypto_secretbox_xchacha20poly1305,
+//where the first 32 bytes of the stream are used as the Poly1305 key
+func xchachaStream(key *[32]byte, nonce *[24]byte) ([32]byte, *chacha20.Cipher) {
+	var polyKey [32]byte
+
+	//Only fails on invalid key or nonce sizes, which are fixed by the types
+	stream, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+
+	return polyKey, stream
+}
+
+//Pad appends the 0x80 marker and zeros up to a multiple of the padding
+//block, without going over max
+func Pad(msg []byte, max int) []byte {
+	size := (len(msg) + paddingBlock) / paddingBlock * paddingBlock
+	if size > max {
+		size = max
+	}
+	if size <= len(msg) {
+		size = len(msg) + 1
+	}
+
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+
+	return padded
+}
+
+//Unpad removes the padding added by Pad
+func Unpad(msg []byte) ([]byte, error) {
+	i := len(msg) - 1
+	for i >= 0 && msg[i] == 0x00 {
+		i--
+	}
+
+	if i < 0 || msg[i] != 0x80 {
+		return nil, fmt.Errorf("invalid DNSCrypt padding")
+	}
+
+	return msg[:i], nil
+}
@@ -0,0 +1,168 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+//Vectors generated with libsodium's crypto_box_curve25519xsalsa20poly1305 and
+//crypto_box_curve25519xchacha20poly1305 beforenm and easy_afternm functions,
+//for the resolver secret key 0x01..0x20, client secret key 0x65..0x84 and
+//nonce 0xc8..0xdf
+const (
+	testResolverPublicKey = "07a37cbc142093c8b755dc1b10e86cb426374ad16aa853ed0bdfc0b2b86d1c7c"
+	testClientPublicKey   = "5714769d116bf76436ae74bc793d2c30ad1903c59ac5273805c7e2698b410c36"
+	testMessage           = "6d696e69646e7320646e736372797074207465737420766563746f72800000"
+)
+
+//sequence 32 bytes counting up from start
+func sequence(start byte) [32]byte {
+	var b [32]byte
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+
+	return b
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func key32(t *testing.T, s string) *[32]byte {
+	t.Helper()
+
+	var k [32]byte
+	copy(k[:], fromHex(t, s))
+
+	return &k
+}
+
+func TestSealOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		es     uint16
+		shared string
+		sealed string
+	}{
+		{
+			name:   "XSalsa20Poly1305",
+			es:     XSalsa20Poly1305,
+			shared: "72da8bbbf5a0760cea2a1d1f2c5f19d54f292f8e7a1dd292b7a86a567ceabc69",
+			sealed: "3b4cf287c2e0de5890d2c55caa5b39b2abd35c3c8ad768f257d7514091770d675288c2d9d312a0980dd1d4bf4d61b3",
+		},
+		{
+			name:   "XChacha20Poly1305",
+			es:     XChacha20Poly1305,
+			shared: "9a4117e68709c989276b31ae77887e707625253a3b97b002b4836ab3b7311864",
+			sealed: "2552235c393372b1a14f5cf1b813c762ef446fb1fadf930cb757e1129f0cc652610d91b0995c3c9d1761ab94e44fe5",
+		},
+	}
+
+	resolverSecret, clientSecret := sequence(0x01), sequence(0x65)
+
+	var nonce [24]byte
+	for i := range nonce {
+		nonce[i] = 0xc8 + byte(i)
+	}
+
+	msg := fromHex(t, testMessage)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := key32(t, tt.shared)
+
+			clientShared, err := SharedKey(tt.es, &clientSecret, key32(t, testResolverPublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolverShared, err := SharedKey(tt.es, &resolverSecret, key32(t, testClientPublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clientShared != *want || resolverShared != *want {
+				t.Fatalf("SharedKey() = %x and %x, want %x", clientShared, resolverShared, *want)
+			}
+
+			sealed := Seal(tt.es, want, &nonce, msg)
+			if !bytes.Equal(sealed, fromHex(t, tt.sealed)) {
+				t.Errorf("Seal() = %x, want %s", sealed, tt.sealed)
+			}
+
+			opened, err := Open(tt.es, want, &nonce, fromHex(t, tt.sealed))
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			if !bytes.Equal(opened, msg) {
+				t.Errorf("Open() = %x, want %x", opened, msg)
+			}
+
+			tampered := fromHex(t, tt.sealed)
+			tampered[len(tampered)-1] ^= 1
+			if _, err := Open(tt.es, want, &nonce, tampered); err == nil {
+				t.Error("Open() accepted a tampered message")
+			}
+
+			if _, err := Open(tt.es, want, &nonce, sealed[:TagLen-1]); err == nil {
+				t.Error("Open() accepted a message shorter than the tag")
+			}
+		})
+	}
+}
+
+func TestSharedKeyUnsupported(t *testing.T) {
+	secret, public := sequence(0x01), sequence(0x65)
+
+	if _, err := SharedKey(3, &secret, &public); err == nil {
+		t.Error("SharedKey() accepted an unknown encryption system")
+	}
+}
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgLen  int
+		max     int
+		wantLen int
+	}{
+		{"to block", 10, 256, 64},
+		{"full block", 64, 256, 128},
+		{"limited by max", 100, 120, 120},
+		{"max too small", 100, 90, 101},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := bytes.Repeat([]byte{0xaa}, tt.msgLen)
+
+			padded := Pad(msg, tt.max)
+			if len(padded) != tt.wantLen {
+				t.Errorf("len(Pad()) = %d, want %d", len(padded), tt.wantLen)
+			}
+
+			unpadded, err := Unpad(padded)
+			if err != nil {
+				t.Fatalf("Unpad() error = %v", err)
+			}
+			if !bytes.Equal(unpadded, msg) {
+				t.Errorf("Unpad() = %x, want %x", unpadded, msg)
+			}
+		})
+	}
+}
+
+func TestUnpadInvalid(t *testing.T) {
+	for _, msg := range [][]byte{{}, {0x00, 0x00}, {0xaa, 0x81, 0x00}} {
+		if _, err := Unpad(msg); err == nil {
+			t.Errorf("Unpad(%x) accepted invalid padding", msg)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/tcfw/minidns/plugins"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	dohMaxMsgSize  = 65535
+)
+
+//dohHandler serves DNS over HTTPS (RFC 8484) requests on top of the plugin chain
+type dohHandler struct {
+	pipeline *plugins.Pipeline
+}
+
+func newDOHHandler(pipeline *plugins.Pipeline) *dohHandler {
+	return &dohHandler{pipeline: pipeline}
+}
+
+func (dh *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reqBytes []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		reqBytes, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(reqBytes) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("content-type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		reqBytes, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dohMaxMsgSize))
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &dnsmessage.Message{}
+	if err := req.Unpack(reqBytes); err != nil || req.Header.Response {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	if !startRequest() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer finishRequest()
+
+	addr, err := httpClientAddr(r)
+	if err != nil {
+		log.Printf("failed to parse DoH client address: %s\n", err)
+	}
+
+	resp := handleRequest(dh.pipeline, nil, addr, req)
+
+	w.Header().Set("content-type", dohContentType)
+	w.Header().Set("content-length", strconv.Itoa(len(resp)))
+	w.Header().Set("cache-control", fmt.Sprintf("max-age=%d", minTTL(req)))
+	w.Write(resp)
+}
+
+//httpClientAddr converts the remote address of the HTTP request into a TCP address
+//so plugins see the client in the same way as other stream transports
+func httpClientAddr(r *http.Request) (net.Addr, error) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}, nil
+}
+
+//minTTL finds the lowest TTL of all answer and authority records, which bounds
+//how long the HTTP response may be cached for
+func minTTL(msg *dnsmessage.Message) uint32 {
+	var min uint32
+	var found bool
+
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range section {
+			if !found || rr.Header.TTL < min {
+				min = rr.Header.TTL
+				found = true
+			}
+		}
+	}
+
+	return min
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/quic-go/quic-go"
+	"github.com/spf13/viper"
+)
+
+//DoQ error codes as per RFC 9250 section 4.3
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+const (
+	doqALPN          = "doq"
+	doqStreamTimeout = 5 * time.Second
+)
+
+//listenForQUICConns serves DNS over QUIC (RFC 9250) on the given packet conn
+func listenForQUICConns(pconn net.PacketConn, tlsConfig *tls.Config, pipeline *plugins.Pipeline) error {
+	ln, err := quic.ListenEarly(pconn, tlsConfig, &quic.Config{
+		MaxIdleTimeout: time.Duration(viper.GetInt("tcp_idle_timeout")) * time.Second,
+		Allow0RTT:      true,
+	})
+	if err != nil {
+		return err
+	}
+	registerListener(ln)
+
+	for {
+		qc, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		go handleQUICConn(qc, pipeline)
+	}
+}
+
+//handleQUICConn accepts streams from the connection, where each stream carries
+//exactly one query and its response
+func handleQUICConn(qc *quic.Conn, pipeline *plugins.Pipeline) {
+	for {
+		s, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go handleQUICStream(qc, s, pipeline)
+	}
+}
+
+func handleQUICStream(qc *quic.Conn, s *quic.Stream, pipeline *plugins.Pipeline) {
+	s.SetDeadline(time.Now().Add(doqStreamTimeout))
+
+	req, err := plugins.ReadTCPMessage(s)
+	if err != nil {
+		if shouldLogVerbose() {
+			log.Printf("failed to read DoQ request from %s: %s\n", qc.RemoteAddr(), err)
+		}
+		qc.CloseWithError(doqProtocolError, "invalid DNS message")
+		return
+	}
+
+	//Message IDs must be 0 as the stream already identifies the query
+	if req.Header.ID != 0 || req.Header.Response {
+		qc.CloseWithError(doqProtocolError, "invalid DNS message header")
+		return
+	}
+
+	if !startRequest() {
+		s.CancelWrite(doqNoError)
+		return
+	}
+	defer finishRequest()
+
+	bytes := handleRequest(pipeline, nil, qc.RemoteAddr(), req)
+
+	if err := plugins.WriteTCPMessage(s, bytes); err != nil {
+		log.Printf("failed to write DoQ response: %s\n", err)
+		s.CancelWrite(doqInternalError)
+		return
+	}
+
+	//Closing the stream sends the FIN indicating the response is complete
+	s.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	envUpgradeKeysFD = "MINIDNS_UPGRADE_KEYS_FD"
+)
+
+var (
+	keyFilesMu sync.Mutex
+
+	//keyFiles the contents of the key and certificate files last read, passed to
+	//the new process on upgrade as it may not be able to read them once
+	//privileges have been dropped
+	keyFiles = map[string][]byte{}
+
+	//inheritedKeyFiles key and certificate files passed from the previous process
+	inheritedKeyFiles = map[string][]byte{}
+)
+
+func init() {
+	fdStr := os.Getenv(envUpgradeKeysFD)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(envUpgradeKeysFD)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.Printf("invalid upgrade keys fd: %s\n", err)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade-keys")
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&inheritedKeyFiles); err != nil {
+		log.Printf("failed to read key files from previous process: %s\n", err)
+	}
+}
+
+//readKeyFile reads a key or certificate file. The contents passed from the
+//previous process are used for the first read of each file after an upgrade
+func readKeyFile(path string) ([]byte, error) {
+	keyFilesMu.Lock()
+	defer keyFilesMu.Unlock()
+
+	data, ok := inheritedKeyFiles[path]
+	if ok {
+		delete(inheritedKeyFiles, path)
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	keyFiles[path] = data
+
+	return data, nil
+}
+
+//rememberKeyFile records the contents of a key file written by this process
+func rememberKeyFile(path string, data []byte) {
+	keyFilesMu.Lock()
+	defer keyFilesMu.Unlock()
+
+	keyFiles[path] = data
+}
+
+//writeKeyFiles sends the key and certificate files to the new process
+func writeKeyFiles(w io.WriteCloser) {
+	defer w.Close()
+
+	keyFilesMu.Lock()
+	files := make(map[string][]byte, len(keyFiles))
+	for path, data := range keyFiles {
+		files[path] = data
+	}
+	keyFilesMu.Unlock()
+
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("failed to pass key files to new process: %s\n", err)
+	}
+}
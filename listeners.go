@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tcfw/minidns/metrics"
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/quic-go/quic-go"
+	"github.com/spf13/viper"
+)
+
+//Listener protocols
+const (
+	protoUDP = "udp"
+	protoTCP = "tcp"
+	protoDoT = "dot"
+	protoDoH = "doh"
+	protoDoQ = "doq"
+
+	protoDNSCrypt = "dnscrypt"
+)
+
+//listenerConfig a single entry of the listeners config
+type listenerConfig struct {
+	Name     string            `mapstructure:"name"`
+	Address  string            `mapstructure:"address"`
+	Protocol string            `mapstructure:"protocol"`
+	Port     int               `mapstructure:"port"`
+	TLS      listenerTLSConfig `mapstructure:"tls"`
+
+	//Metrics serves the Prometheus metrics endpoint on DoH listeners
+	Metrics bool `mapstructure:"metrics"`
+
+	//View the plugin pipeline requests received by the listener run through
+	View string `mapstructure:"view"`
+
+	//ProxyProtocol expects connections from the trusted proxies to start with a
+	//PROXY protocol header giving the real client address
+	ProxyProtocol  bool     `mapstructure:"proxy_protocol"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	DNSCrypt listenerDNSCryptConfig `mapstructure:"dnscrypt"`
+}
+
+//listenerTLSConfig certificate for TLS based listeners, falling back to the
+//global tls_cert and tls_key. TLS is always enabled for DoT and DoQ and for DoH
+//when enabled or a certificate is given
+type listenerTLSConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Cert    string `mapstructure:"cert"`
+	Key     string `mapstructure:"key"`
+}
+
+//listenerDNSCryptConfig provider settings for DNSCrypt listeners, falling back to
+//the global dnscrypt_ settings
+type listenerDNSCryptConfig struct {
+	ProviderName string `mapstructure:"provider_name"`
+	Key          string `mapstructure:"key"`
+
+	//CertTTL hours each short-term certificate is valid for
+	CertTTL int `mapstructure:"cert_ttl"`
+
+	//StampAddress the public address of the listener for the sdns:// stamp
+	StampAddress string `mapstructure:"stamp_address"`
+}
+
+//hostPort the address to listen on, handling IPv6 literals and any address
+func (lc listenerConfig) hostPort() string {
+	host := strings.Trim(lc.Address, "[]")
+	if host == "any" || host == "*" {
+		host = ""
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(lc.Port))
+}
+
+//defaultName names the listener by its protocol, address and port, such as
+//udp-127.0.0.1-53. Names can't contain ':' as they are matched against systemd's
+//FileDescriptorName, so ':' in IPv6 addresses is replaced by '_'
+func (lc listenerConfig) defaultName() string {
+	host := strings.Trim(lc.Address, "[]")
+	if host == "" || host == "*" {
+		host = "any"
+	}
+
+	return fmt.Sprintf("%s-%s-%d", lc.Protocol, strings.ReplaceAll(host, ":", "_"), lc.Port)
+}
+
+func (lc listenerConfig) String() string {
+	return fmt.Sprintf("%s (%s on %s, view %s)", lc.Name, lc.Protocol, lc.hostPort(), lc.View)
+}
+
+//pipeline the plugin pipeline of the listener's view
+func (lc listenerConfig) pipeline() *plugins.Pipeline {
+	return plugins.View(lc.View)
+}
+
+//hasTLS checks if TLS has been configured for the listener
+func (lc listenerConfig) hasTLS() bool {
+	return lc.TLS.Enabled && lc.TLS.Cert != "" && lc.TLS.Key != ""
+}
+
+//loadListenerConfigs reads the listeners config, or builds the equivalent from
+//the bind and port settings when not set
+func loadListenerConfigs() ([]listenerConfig, error) {
+	var cfgs []listenerConfig
+
+	if viper.IsSet("listeners") {
+		if err := viper.UnmarshalKey("listeners", &cfgs); err != nil {
+			return nil, fmt.Errorf("failed to parse listeners: %s", err)
+		}
+	} else {
+		cfgs = legacyListenerConfigs()
+	}
+
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		cfg.Protocol = strings.ToLower(cfg.Protocol)
+
+		if cfg.Port == 0 {
+			cfg.Port = defaultPort(cfg.Protocol)
+		}
+
+		if cfg.Protocol == protoDoT || cfg.Protocol == protoDoQ || cfg.TLS.Cert != "" {
+			cfg.TLS.Enabled = true
+		}
+
+		if cfg.TLS.Enabled && cfg.TLS.Cert == "" && cfg.TLS.Key == "" {
+			cfg.TLS.Cert = viper.GetString("tls_cert")
+			cfg.TLS.Key = viper.GetString("tls_key")
+		}
+
+		if cfg.Name == "" {
+			cfg.Name = cfg.defaultName()
+		}
+
+		if cfg.View == "" {
+			cfg.View = plugins.DefaultView
+		}
+
+		if plugins.View(cfg.View) == nil {
+			return nil, fmt.Errorf("listener %s has unknown view %q", cfg.Name, cfg.View)
+		}
+
+		if cfg.Protocol == protoDNSCrypt {
+			if cfg.DNSCrypt.ProviderName == "" {
+				cfg.DNSCrypt.ProviderName = viper.GetString("dnscrypt_provider_name")
+			}
+			if cfg.DNSCrypt.Key == "" {
+				cfg.DNSCrypt.Key = viper.GetString("dnscrypt_key")
+			}
+			if cfg.DNSCrypt.CertTTL == 0 {
+				cfg.DNSCrypt.CertTTL = viper.GetInt("dnscrypt_cert_ttl")
+			}
+			if cfg.DNSCrypt.CertTTL <= 0 {
+				return nil, fmt.Errorf("listener %s: DNSCrypt cert_ttl must be positive", cfg.Name)
+			}
+
+			if !strings.HasPrefix(cfg.DNSCrypt.ProviderName, "2.dnscrypt-cert.") {
+				return nil, fmt.Errorf("listener %s: DNSCrypt provider name must start with 2.dnscrypt-cert.", cfg.Name)
+			}
+		}
+
+		switch cfg.Protocol {
+		case protoUDP, protoTCP, protoDoH, protoDoT, protoDoQ, protoDNSCrypt:
+		default:
+			return nil, fmt.Errorf("listener %s has unknown protocol %q", cfg.Name, cfg.Protocol)
+		}
+
+		if cfg.Metrics && cfg.Protocol != protoDoH {
+			return nil, fmt.Errorf("listener %s: metrics are only supported for doh", cfg.Name)
+		}
+
+		if cfg.ProxyProtocol {
+			if cfg.Protocol != protoTCP && cfg.Protocol != protoDoT && cfg.Protocol != protoDoH {
+				return nil, fmt.Errorf("listener %s: PROXY protocol is only supported for tcp, dot and doh", cfg.Name)
+			}
+
+			if len(cfg.TrustedProxies) == 0 {
+				return nil, fmt.Errorf("listener %s: PROXY protocol requires trusted_proxies", cfg.Name)
+			}
+		}
+
+		if cfg.TLS.Enabled && !cfg.hasTLS() {
+			return nil, fmt.Errorf("listener %s requires a TLS certificate and key", cfg)
+		}
+	}
+
+	return cfgs, nil
+}
+
+//legacyListenerConfigs builds listeners for each bind address from the port settings
+func legacyListenerConfigs() []listenerConfig {
+	cfgs := []listenerConfig{}
+
+	for _, addr := range viper.GetStringSlice("bind") {
+		cfgs = append(cfgs,
+			listenerConfig{Address: addr, Protocol: protoUDP, Port: viper.GetInt("port")},
+			listenerConfig{Address: addr, Protocol: protoTCP, Port: viper.GetInt("port")},
+			listenerConfig{Address: addr, Protocol: protoDoH, Port: viper.GetInt("http_port"), Metrics: true},
+		)
+
+		if tlsEnabled() {
+			cfgs = append(cfgs,
+				listenerConfig{Address: addr, Protocol: protoDoT, Port: viper.GetInt("dot_port")},
+				listenerConfig{Address: addr, Protocol: protoDoQ, Port: viper.GetInt("doq_port")},
+			)
+
+			if viper.GetBool("doh_tls") {
+				cfgs = append(cfgs, listenerConfig{Address: addr, Protocol: protoDoH, Port: viper.GetInt("https_port"), TLS: listenerTLSConfig{Enabled: true}})
+			}
+		}
+	}
+
+	return cfgs
+}
+
+func defaultPort(protocol string) int {
+	switch protocol {
+	case protoDoT, protoDoQ:
+		return 853
+	case protoDoH, protoDNSCrypt:
+		return 443
+	default:
+		return 53
+	}
+}
+
+//listenerSet starts configured listeners, sharing the UDP worker pool and TLS
+//certificates between them
+type listenerSet struct {
+	pool  *workerPool
+	certs map[string]*certReloader
+}
+
+//setupListeners starts all configured listeners
+func setupListeners() {
+	cfgs, err := loadListenerConfigs()
+	if err != nil {
+		panic(err)
+	}
+
+	adoptActivated(cfgs)
+
+	metrics.RegisterHTTPHandler()
+
+	ls := &listenerSet{
+		pool:  newUDPWorkerPool(),
+		certs: map[string]*certReloader{},
+	}
+
+	for _, cfg := range cfgs {
+		var err error
+
+		switch cfg.Protocol {
+		case protoUDP:
+			err = ls.startUDP(cfg)
+		case protoTCP:
+			err = ls.startTCP(cfg)
+		case protoDoT:
+			err = ls.startDoT(cfg)
+		case protoDoH:
+			err = ls.startDoH(cfg)
+		case protoDoQ:
+			err = ls.startDoQ(cfg)
+		case protoDNSCrypt:
+			err = ls.startDNSCrypt(cfg)
+		}
+
+		if err != nil {
+			panic(fmt.Errorf("failed to start listener %s: %s", cfg, err))
+		}
+	}
+
+	log.Println("Listening for DNS requests")
+}
+
+func (ls *listenerSet) startUDP(cfg listenerConfig) error {
+	conns, err := listenPacketReusePort("udp", cfg.hostPort(), viper.GetInt("udp_sockets"))
+	if err != nil {
+		return err
+	}
+
+	//Each socket gets its own read loop and message pool
+	for _, c := range conns {
+		bc := newBatchPacketConn(c, viper.GetInt("udp_batch_size"))
+		registerPacketConn(bc)
+
+		go listenForUDPMessages(bc, ls.pool, cfg.pipeline())
+	}
+
+	log.Printf("Started listener %s", cfg)
+
+	return nil
+}
+
+//tlsConfig gets the TLS config for the listener sharing reloaders between
+//listeners using the same certificate
+func (ls *listenerSet) tlsConfig(cfg listenerConfig, nextProtos ...string) (*tls.Config, error) {
+	key := cfg.TLS.Cert + ":" + cfg.TLS.Key
+
+	cr, ok := ls.certs[key]
+	if !ok {
+		var err error
+		cr, err = newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		ls.certs[key] = cr
+	}
+
+	return cr.tlsConfig(nextProtos...), nil
+}
+
+//listenTCP opens the stream listener, parsing PROXY protocol headers if enabled
+func (ls *listenerSet) listenTCP(cfg listenerConfig) (net.Listener, error) {
+	ln, err := listen("tcp", cfg.hostPort())
+	if err != nil {
+		return nil, err
+	}
+	registerListener(ln)
+
+	if !cfg.ProxyProtocol {
+		return ln, nil
+	}
+
+	return newProxyListener(ln, cfg.TrustedProxies)
+}
+
+func (ls *listenerSet) startTCP(cfg listenerConfig) error {
+	ln, err := ls.listenTCP(cfg)
+	if err != nil {
+		return err
+	}
+
+	go listenForTCPConns(ln, cfg.pipeline())
+
+	log.Printf("Started listener %s", cfg)
+
+	return nil
+}
+
+func (ls *listenerSet) startDoT(cfg listenerConfig) error {
+	tlsConfig, err := ls.tlsConfig(cfg, "dot")
+	if err != nil {
+		return err
+	}
+
+	ln, err := ls.listenTCP(cfg)
+	if err != nil {
+		return err
+	}
+
+	go listenForTCPConns(tls.NewListener(ln, tlsConfig), cfg.pipeline())
+
+	log.Printf("Started listener %s", cfg)
+
+	return nil
+}
+
+//startDoH serves DNS over HTTPS, and the metrics endpoint if enabled, using TLS
+//when the listener has a certificate
+func (ls *listenerSet) startDoH(cfg listenerConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, newDOHHandler(cfg.pipeline()))
+	if cfg.Metrics {
+		mux.Handle(metrics.HTTPPath, http.DefaultServeMux)
+	}
+
+	srv := &http.Server{Handler: mux}
+
+	useTLS := cfg.hasTLS()
+	if useTLS {
+		var err error
+		srv.TLSConfig, err = ls.tlsConfig(cfg, "h2", "http/1.1")
+		if err != nil {
+			return err
+		}
+	}
+
+	ln, err := listen("tcp", cfg.hostPort())
+	if err != nil {
+		return err
+	}
+	registerHTTPServer(srv)
+
+	if cfg.ProxyProtocol {
+		if ln, err = newProxyListener(ln, cfg.TrustedProxies); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	log.Printf("Started listener %s", cfg)
+
+	return nil
+}
+
+func (ls *listenerSet) startDoQ(cfg listenerConfig) error {
+	tlsConfig, err := ls.tlsConfig(cfg, doqALPN)
+	if err != nil {
+		return err
+	}
+
+	doqConn, err := listenPacket("udp", cfg.hostPort())
+	if err != nil {
+		return err
+	}
+	registerPacketConn(doqConn)
+
+	go func() {
+		if err := listenForQUICConns(doqConn, tlsConfig, cfg.pipeline()); err != quic.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	log.Printf("Started listener %s", cfg)
+
+	return nil
+}
+
+//startDNSCrypt serves DNSCrypt over both UDP and TCP on the listener's port
+func (ls *listenerSet) startDNSCrypt(cfg listenerConfig) error {
+	ds, err := newDNSCryptServer(cfg.DNSCrypt.ProviderName, cfg.DNSCrypt.Key, time.Duration(cfg.DNSCrypt.CertTTL)*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	pconn, err := listenPacket("udp", cfg.hostPort())
+	if err != nil {
+		return err
+	}
+	registerPacketConn(pconn)
+
+	ln, err := listen("tcp", cfg.hostPort())
+	if err != nil {
+		return err
+	}
+	registerListener(ln)
+
+	go listenForDNSCryptUDP(pconn, ds, ls.pool, cfg.pipeline())
+	go listenForDNSCryptTCP(ln, ds, cfg.pipeline())
+
+	stampAddr := cfg.DNSCrypt.StampAddress
+	if stampAddr == "" {
+		stampAddr = cfg.hostPort()
+		if host, port, _ := net.SplitHostPort(stampAddr); host == "" || net.ParseIP(host).IsUnspecified() {
+			stampAddr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	log.Printf("Started listener %s", cfg)
+	log.Printf("DNSCrypt stamp for %s: %s", cfg.Name, ds.stamp(stampAddr))
+
+	return nil
+}
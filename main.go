@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net"
-	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/tcfw/minidns/metrics"
@@ -20,71 +20,127 @@ func main() {
 		setInternalResolver()
 	}
 
-	setupHTTPHandler()
-	setupDNSHandler()
-}
-
-func setupHTTPHandler() {
-	metrics.RegisterHTTPHandler()
-
-	for _, addr := range viper.GetStringSlice("bind") {
-		go func(addr string) {
-			log.Println(http.ListenAndServe(fmt.Sprintf("%s:%d", addr, viper.GetInt("http_port")), nil))
-		}(addr)
+	if err := plugins.Setup(); err != nil {
+		panic(err)
 	}
 
-	log.Println("Listening for HTTP requests...")
-}
-
-func setupDNSHandler() {
-	for _, addr := range viper.GetStringSlice("bind") {
-		conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", addr, viper.GetInt("port")))
-		if err != nil {
+	//When taking over from a running process it keeps serving until our plugins
+	//are ready, so there is no window with unloaded blocklists. Privileges were
+	//normally already dropped by the previous process, but are dropped here if
+	//not so plugins never start as root
+	if isUpgrade() {
+		if err := dropPrivileges(); err != nil {
 			panic(err)
 		}
-		defer conn.Close()
+		plugins.Start()
+		plugins.WaitReady()
+	}
 
-		go listenForUDPMessages(conn)
+	setupListeners()
+
+	if err := dropPrivileges(); err != nil {
+		panic(err)
 	}
+	plugins.Start()
+
+	closeUnusedInherited()
+	notifyUpgradeReady()
+	notifySystemdReady()
 
-	log.Println("Listening for DNS requests")
-	select {}
+	waitForShutdown()
 }
 
-func listenForUDPMessages(conn net.PacketConn) error {
-	buffPool := NewBufferPool()
+func listenForUDPMessages(conn *batchPacketConn, pool *workerPool, pipeline *plugins.Pipeline) error {
 	for {
-		buf := buffPool.Get()
-		buf.Grow(1024)
-		b := buf.Bytes()[:1024]
-
-		n, addr, _ := conn.ReadFrom(b)
-		msg := &dnsmessage.Message{}
-		if err := msg.Unpack(b[:n]); err != nil {
-			log.Printf("failed to parse DNS request: %s\n", err)
+		batch, n, err := conn.ReadBatch()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("failed to read DNS request: %s\n", err)
 			continue
 		}
 
-		buffPool.Put(buf)
+		for _, dgram := range (*batch)[:n] {
+			msg := &dnsmessage.Message{}
+			if err := msg.Unpack(dgram.Buffers[0][:dgram.N]); err != nil {
+				log.Printf("failed to parse DNS request: %s\n", err)
+				continue
+			}
+
+			dispatchUDPMessage(pipeline, conn, dgram.Addr, msg, pool)
+		}
 
-		go handleUDPRequest(conn, addr, msg)
+		conn.ReleaseBatch(batch)
 	}
 }
 
-func handleUDPRequest(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) {
-	if !req.Header.Response {
-		metrics.IncRequests("request")
+//dispatchUDPMessage hands the received query to a worker
+func dispatchUDPMessage(pipeline *plugins.Pipeline, conn net.PacketConn, addr net.Addr, msg *dnsmessage.Message, pool *workerPool) {
+	//Only queries are accepted, upstream responses are received by the forwarders
+	if msg.Header.Response {
+		return
 	}
 
+	//While handing off to a new process the socket is shared, so queries read
+	//here are still answered rather than dropped
+	tracked := startRequest()
+	if !tracked && atomic.LoadInt32(&handingOff) == 0 {
+		return
+	}
+
+	pool.submit(udpJob{pipeline: pipeline, conn: conn, addr: addr, req: msg, tracked: tracked})
+}
+
+func handleUDPRequest(pipeline *plugins.Pipeline, conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) {
+	limit := udpResponseLimit(req)
+
+	bytes := handleRequest(pipeline, conn, addr, req)
+
+	if len(bytes) > limit {
+		truncated, err := truncate(req, limit)
+		if err != nil {
+			log.Printf("failed to truncate DNS response: %s\n", err)
+			truncated = truncatedHeader(req)
+		}
+		bytes = truncated
+		metrics.IncRequests("truncated")
+	}
+
+	conn.WriteTo(bytes, addr)
+}
+
+//handleRequest runs the query through the plugin pipeline of the listener's view
+//and returns the packed response. The conn is only set for queries received over UDP
+func handleRequest(pipeline *plugins.Pipeline, conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) []byte {
+	metrics.IncRequests("request")
+
 	if shouldLogVerbose() {
 		log.Printf("Query: %+v", req.Questions)
 	}
 
-	if err := plugins.ChainRequest(conn, addr, req); err != nil {
-		metrics.IncRequests("failed")
-		log.Printf("failed to handle DNS request: %s\n", err)
+	edns := plugins.ParseEDNS(req)
+
+	switch {
+	case plugins.CountEDNS(req) > 1:
+		//Multiple OPT records are a format error (RFC 6891 section 6.1.1)
+		req.Header.Response = true
+		req.Header.RCode = dnsmessage.RCodeFormatError
+		plugins.RemoveEDNS(req)
+		edns = nil
+	case edns != nil && edns.Version != 0:
+		req.Header.Response = true
+		req.Header.RCode = plugins.RCodeBadVers & 0xf
+		plugins.SetEDNS(req, &plugins.EDNS{ExtendedRCode: plugins.RCodeBadVers >> 4})
+	default:
+		if err := pipeline.ChainRequest(conn, addr, req); err != nil {
+			metrics.IncRequests("failed")
+			log.Printf("failed to handle DNS request: %s\n", err)
+		}
 	}
 
+	plugins.SetResponseEDNS(req, edns)
+
 	var rejected bool = false
 
 	if !req.Header.Response || len(req.Answers) == 0 {
@@ -93,7 +149,6 @@ func handleUDPRequest(conn net.PacketConn, addr net.Addr, req *dnsmessage.Messag
 	}
 
 	bytes, _ := req.Pack()
-	conn.WriteTo(bytes, addr)
 
 	if shouldLogVeryVerbose() {
 		log.Printf("Response: %+v", req)
@@ -102,10 +157,22 @@ func handleUDPRequest(conn net.PacketConn, addr net.Addr, req *dnsmessage.Messag
 	if !rejected {
 		metrics.IncRequests("handled")
 	}
+
+	return bytes
 }
 
 func setInternalResolver() {
-	upstreams := viper.GetStringSlice("forwarders")
+	var upstream string
+	for _, forwarder := range viper.GetStringSlice("forwarders") {
+		if addr, ok := plugins.PlainUpstreamAddress(forwarder); ok {
+			upstream = addr
+			break
+		}
+	}
+	if upstream == "" {
+		log.Println("no plain DNS forwarder for the internal resolver, using the system resolver")
+		return
+	}
 
 	net.DefaultResolver = &net.Resolver{
 		PreferGo: true,
@@ -113,7 +180,7 @@ func setInternalResolver() {
 			d := net.Dialer{
 				Timeout: time.Millisecond * time.Duration(10000),
 			}
-			return d.DialContext(ctx, "udp", fmt.Sprintf("%s:53", upstreams[0]))
+			return d.DialContext(ctx, network, upstream)
 		},
 	}
 }
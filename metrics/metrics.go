@@ -13,6 +13,8 @@ import (
 //Store holds various prom metrics
 type Store struct {
 	requests      *prometheus.CounterVec
+	queueDepth    prometheus.Gauge
+	shed          *prometheus.CounterVec
 	pluginMetrics map[string]prometheus.Metric
 }
 
@@ -26,13 +28,24 @@ func newMetrics() *Store {
 			Name: "minidns_request_totals",
 			Help: "Total number of requests processed",
 		}, []string{"type"}),
+		queueDepth: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "minidns_udp_queue_depth",
+			Help: "Number of UDP requests waiting for a worker",
+		}),
+		shed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "minidns_udp_shed_totals",
+			Help: "Total number of UDP requests shed due to overload",
+		}, []string{"policy"}),
 		pluginMetrics: map[string]prometheus.Metric{},
 	}
 }
 
+//HTTPPath the path of the metrics endpoint
+const HTTPPath = "/metrics"
+
 //RegisterHTTPHandler register the promhttp handler on /metrics
 func RegisterHTTPHandler() {
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(HTTPPath, promhttp.Handler())
 	log.Println("Register Prometheus metrics endpoint")
 }
 
@@ -41,6 +54,16 @@ func (m *Store) IncRequests(label string) {
 	m.requests.WithLabelValues(label).Inc()
 }
 
+//AddQueueDepth adjust the UDP worker queue depth
+func (m *Store) AddQueueDepth(delta float64) {
+	m.queueDepth.Add(delta)
+}
+
+//IncShed increment the shed request counter
+func (m *Store) IncShed(policy string) {
+	m.shed.WithLabelValues(policy).Inc()
+}
+
 //RegisterPluginMetric add a custom metric
 func (m *Store) RegisterPluginMetric(name string, metric prometheus.Metric) error {
 	if _, ok := m.pluginMetrics[name]; ok {
@@ -69,3 +92,13 @@ func GetMetrics() *Store {
 func IncRequests(label string) {
 	metrics.IncRequests(label)
 }
+
+//AddQueueDepth adjust the UDP worker queue depth
+func AddQueueDepth(delta float64) {
+	metrics.AddQueueDepth(delta)
+}
+
+//IncShed increment the shed request counter
+func IncShed(policy string) {
+	metrics.IncShed(policy)
+}
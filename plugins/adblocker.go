@@ -19,11 +19,6 @@ import (
 )
 
 func init() {
-	blocker := &adblocker{
-		blocked:   map[string]bool{},
-		whitelist: map[string]bool{},
-	}
-
 	mStore := metrics.GetMetrics()
 
 	mStore.RegisterPluginMetric("adblocker_blacklist", promauto.NewGauge(prometheus.GaugeOpts{
@@ -41,15 +36,29 @@ func init() {
 		Help: "Number of times adblocker has updated black/whitelists",
 	}))
 
-	go blocker.Start()
+	Register("ad_blocker", newAdblocker)
+}
+
+func newAdblocker(settings *viper.Viper) (DNSPlugin, error) {
+	blocker := &adblocker{
+		settings:  settings,
+		blocked:   map[string]bool{},
+		whitelist: map[string]bool{},
+		stop:      make(chan struct{}),
+		ready:     make(chan struct{}),
+	}
 
-	Register(blocker)
+	return blocker, nil
 }
 
 type adblocker struct {
 	lock      sync.RWMutex
+	settings  *viper.Viper
 	blocked   map[string]bool
 	whitelist map[string]bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+	ready     chan struct{}
 }
 
 func (ab *adblocker) Name() string {
@@ -83,21 +92,40 @@ func (ab *adblocker) ServeDNS(h DNSHandler) DNSHandler {
 
 func (ab *adblocker) Start() {
 	ab.update()
+	close(ab.ready)
 
 	timer := time.NewTicker(1 * time.Hour)
-	for range timer.C {
-		ab.update()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			ab.update()
+		case <-ab.stop:
+			return
+		}
 	}
 }
 
+//Ready is closed once the lists have been loaded for the first time
+func (ab *adblocker) Ready() <-chan struct{} {
+	return ab.ready
+}
+
+//Shutdown stops the list update ticker
+func (ab *adblocker) Shutdown() error {
+	ab.stopOnce.Do(func() { close(ab.stop) })
+	return nil
+}
+
 func (ab *adblocker) update() {
-	if !viper.GetBool("ready") {
+	if !ab.settings.GetBool("ready") {
 		time.Sleep(50 * time.Millisecond)
 		ab.update()
 		return
 	}
 
-	whitelist := viper.GetStringSlice("whitelist")
+	whitelist := ab.settings.GetStringSlice("whitelist")
 	for _, domain := range whitelist {
 		ab.whitelist[domain] = true
 	}
@@ -106,7 +134,7 @@ func (ab *adblocker) update() {
 		log.Printf("Whitelisted %d domain(s)...", len(ab.whitelist))
 	}
 
-	blacklist := viper.GetStringSlice("blacklist")
+	blacklist := ab.settings.GetStringSlice("blacklist")
 	for _, domain := range blacklist {
 		ab.blocked[domain] = true
 	}
@@ -128,7 +156,7 @@ func (ab *adblocker) update() {
 }
 
 func (ab *adblocker) updateBlocklist(wg *sync.WaitGroup) {
-	blocklists := viper.GetStringSlice("blocklists")
+	blocklists := ab.settings.GetStringSlice("blocklists")
 	log.Printf("Updating block list from %d sources...\n", len(blocklists))
 	ab.updateList(blocklists, ab.blocked)
 	log.Printf("Updated block list: %d hosts blocked", len(ab.blocked))
@@ -136,7 +164,7 @@ func (ab *adblocker) updateBlocklist(wg *sync.WaitGroup) {
 }
 
 func (ab *adblocker) updateWhitelist(wg *sync.WaitGroup) {
-	whitelists := viper.GetStringSlice("whitelists")
+	whitelists := ab.settings.GetStringSlice("whitelists")
 	log.Printf("Updating whitelist from %d sources...\n", len(whitelists))
 	ab.updateList(whitelists, ab.whitelist)
 	log.Printf("Updated whitelist: %d whitelisted hosts", len(ab.whitelist))
@@ -0,0 +1,308 @@
+package plugins
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//Upstream selection strategies
+const (
+	strategySequential = "sequential"
+	strategyRoundRobin = "round_robin"
+	strategyRandom     = "random"
+	strategyFastest    = "fastest"
+	strategyParallel   = "parallel"
+)
+
+const (
+	//ewmaWeight weight of each new sample in the latency and error rate averages
+	ewmaWeight = 0.2
+
+	//retryBackoff how long an upstream which is down is skipped before a query
+	//is sent to it again, doubling after each failed retry up to maxRetryBackoff
+	retryBackoff    = 5 * time.Second
+	maxRetryBackoff = 2 * time.Minute
+)
+
+//trackedUpstream an upstream with its health, from queries (passive) and
+//periodic probe queries (active)
+type trackedUpstream struct {
+	Upstream
+
+	mu        sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	fails     int
+	down      bool
+	backoff   time.Duration
+	retryAt   time.Time
+}
+
+//record updates the averages after a query, marking the upstream down after
+//maxFails consecutive failures and up again after a success
+func (t *trackedUpstream) record(rtt time.Duration, err error, maxFails int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.errorRate = t.errorRate*(1-ewmaWeight) + ewmaWeight
+		t.fails++
+
+		if !t.down && t.fails >= maxFails {
+			t.down = true
+			t.backoff = retryBackoff
+			t.retryAt = time.Now().Add(t.backoff)
+			log.Printf("upstream %s is down after %d failures: %s\n", t.Upstream, t.fails, err)
+		}
+		return
+	}
+
+	t.errorRate = t.errorRate * (1 - ewmaWeight)
+	t.fails = 0
+
+	if t.down {
+		t.down = false
+		log.Printf("upstream %s is up", t.Upstream)
+	}
+
+	if t.latency == 0 {
+		t.latency = rtt
+	} else {
+		t.latency = time.Duration(float64(t.latency)*(1-ewmaWeight) + float64(rtt)*ewmaWeight)
+	}
+}
+
+//available checks if the upstream is up, or is down but due to be retried. Only
+//one query is let through for each retry, backing off further each time, so
+//upstreams are brought back by queries even when probes are disabled
+func (t *trackedUpstream) available(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.down {
+		return true
+	}
+
+	if now.Before(t.retryAt) {
+		return false
+	}
+
+	if t.backoff *= 2; t.backoff > maxRetryBackoff {
+		t.backoff = maxRetryBackoff
+	}
+	t.retryAt = now.Add(t.backoff)
+
+	return true
+}
+
+//expectedLatency the average time a query takes, counting failures as a timeout
+func (t *trackedUpstream) expectedLatency() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return time.Duration(float64(t.latency)*(1-t.errorRate) + float64(upstreamTimeout)*t.errorRate)
+}
+
+//upstreamPool chooses which upstreams to query using the configured strategy,
+//skipping upstreams which are down until a probe or retried query succeeds
+type upstreamPool struct {
+	upstreams     []*trackedUpstream
+	strategy      string
+	parallel      int
+	maxFails      int
+	probeInterval time.Duration
+
+	next     uint32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newUpstreamPool(upstreams []Upstream, settings *viper.Viper) (*upstreamPool, error) {
+	p := &upstreamPool{
+		strategy:      settings.GetString("upstream_strategy"),
+		parallel:      settings.GetInt("upstream_parallel"),
+		maxFails:      settings.GetInt("upstream_max_fails"),
+		probeInterval: time.Duration(settings.GetInt("upstream_probe_interval")) * time.Second,
+		stop:          make(chan struct{}),
+	}
+
+	switch p.strategy {
+	case strategySequential, strategyRoundRobin, strategyRandom, strategyFastest, strategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", p.strategy)
+	}
+
+	if p.parallel < 1 {
+		p.parallel = 1
+	}
+	if p.maxFails < 1 {
+		p.maxFails = 1
+	}
+
+	for _, u := range upstreams {
+		p.upstreams = append(p.upstreams, &trackedUpstream{Upstream: u})
+	}
+
+	return p, nil
+}
+
+//Exchange sends the query to the upstreams in the order of the strategy until
+//one responds, returning nil if none did
+func (p *upstreamPool) Exchange(req *dnsmessage.Message) *dnsmessage.Message {
+	candidates := p.candidates()
+
+	if p.strategy == strategyParallel {
+		n := p.parallel
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+
+		if resp := p.race(candidates[:n], req); resp != nil {
+			return resp
+		}
+		candidates = candidates[n:]
+	}
+
+	for _, u := range candidates {
+		if resp, err := p.exchange(u, req); err == nil {
+			return resp
+		}
+	}
+
+	return nil
+}
+
+//race sends the query to each of the upstreams at once, returning the first response
+func (p *upstreamPool) race(upstreams []*trackedUpstream, req *dnsmessage.Message) *dnsmessage.Message {
+	responses := make(chan *dnsmessage.Message, len(upstreams))
+
+	for _, u := range upstreams {
+		//Each query gets its own copy as the request is changed into the
+		//response once the first upstream answers
+		snapshot := *req
+		snapshot.Questions = append([]dnsmessage.Question{}, req.Questions...)
+		snapshot.Additionals = append([]dnsmessage.Resource{}, req.Additionals...)
+
+		go func(u *trackedUpstream, req *dnsmessage.Message) {
+			resp, _ := p.exchange(u, req)
+			responses <- resp
+		}(u, &snapshot)
+	}
+
+	for range upstreams {
+		if resp := <-responses; resp != nil {
+			return resp
+		}
+	}
+
+	return nil
+}
+
+//exchange queries the upstream, recording the outcome
+func (p *upstreamPool) exchange(u *trackedUpstream, req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	sTime := time.Now()
+
+	resp, err := u.Exchange(req)
+	u.record(time.Since(sTime), err, p.maxFails)
+	if err != nil {
+		log.Printf("failed to query upstream %s: %s\n", u.Upstream, err)
+	}
+
+	return resp, err
+}
+
+//candidates the upstreams which are up or due a retry in the order of the
+//strategy. If all upstreams are down, they are all tried rather than failing
+//every query
+func (p *upstreamPool) candidates() []*trackedUpstream {
+	now := time.Now()
+
+	candidates := make([]*trackedUpstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, p.upstreams...)
+	}
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		start := int(atomic.AddUint32(&p.next, 1) % uint32(len(candidates)))
+		candidates = append(candidates[start:], candidates[:start]...)
+	case strategyRandom:
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	case strategyFastest:
+		latencies := make(map[*trackedUpstream]time.Duration, len(candidates))
+		for _, u := range candidates {
+			latencies[u] = u.expectedLatency()
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return latencies[candidates[i]] < latencies[candidates[j]]
+		})
+	}
+
+	return candidates
+}
+
+//Start probes each upstream every probe interval, which updates latencies of
+//idle upstreams and brings back upstreams which are down once they respond
+func (p *upstreamPool) Start() {
+	if p.probeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func(u *trackedUpstream) {
+				defer wg.Done()
+				p.probe(u)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+//probe queries the upstream for the root NS records
+func (p *upstreamPool) probe(u *trackedUpstream) {
+	req := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: randomID(), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}},
+	}
+
+	sTime := time.Now()
+
+	resp, err := u.Exchange(req)
+	if err == nil && resp.Header.RCode == dnsmessage.RCodeServerFailure {
+		err = fmt.Errorf("probe failed with SERVFAIL")
+	}
+	u.record(time.Since(sTime), err, p.maxFails)
+}
+
+//Shutdown stops probing the upstreams
+func (p *upstreamPool) Shutdown() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
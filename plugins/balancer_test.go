@@ -0,0 +1,170 @@
+package plugins
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestPool(t *testing.T, strategy string, upstreams ...Upstream) *upstreamPool {
+	t.Helper()
+
+	settings := viper.New()
+	settings.Set("upstream_strategy", strategy)
+	settings.Set("upstream_max_fails", 1)
+
+	p, err := newUpstreamPool(upstreams, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func candidateNames(candidates []*trackedUpstream) []string {
+	names := make([]string, 0, len(candidates))
+	for _, u := range candidates {
+		names = append(names, u.String())
+	}
+
+	return names
+}
+
+func TestUpstreamPoolCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+
+		//down upstreams, which are not due a retry
+		down []int
+
+		//latencies of each upstream for the fastest strategy
+		latencies []time.Duration
+
+		//want the candidates of successive queries
+		want [][]string
+	}{
+		{
+			name:     "sequential",
+			strategy: strategySequential,
+			want:     [][]string{{"a", "b", "c"}, {"a", "b", "c"}},
+		},
+		{
+			name:     "sequential skips down",
+			strategy: strategySequential,
+			down:     []int{0},
+			want:     [][]string{{"b", "c"}},
+		},
+		{
+			name:     "all down",
+			strategy: strategySequential,
+			down:     []int{0, 1, 2},
+			want:     [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:     "round robin",
+			strategy: strategyRoundRobin,
+			want:     [][]string{{"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}},
+		},
+		{
+			name:     "round robin skips down",
+			strategy: strategyRoundRobin,
+			down:     []int{1},
+			want:     [][]string{{"c", "a"}, {"a", "c"}},
+		},
+		{
+			name:      "fastest",
+			strategy:  strategyFastest,
+			latencies: []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			want:      [][]string{{"b", "c", "a"}},
+		},
+		{
+			name:      "fastest skips down",
+			strategy:  strategyFastest,
+			down:      []int{1},
+			latencies: []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			want:      [][]string{{"c", "a"}},
+		},
+		{
+			name:     "parallel",
+			strategy: strategyParallel,
+			want:     [][]string{{"a", "b", "c"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(t, tt.strategy, &testUpstream{name: "a"}, &testUpstream{name: "b"}, &testUpstream{name: "c"})
+
+			for _, i := range tt.down {
+				p.upstreams[i].record(0, errors.New("failed"), p.maxFails)
+			}
+			for i, latency := range tt.latencies {
+				p.upstreams[i].latency = latency
+			}
+
+			for _, want := range tt.want {
+				if got := candidateNames(p.candidates()); !reflect.DeepEqual(got, want) {
+					t.Errorf("candidates() = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolRetriesDown(t *testing.T) {
+	a := &testUpstream{name: "a"}
+	b := &testUpstream{name: "b"}
+	p := newTestPool(t, strategySequential, a, b)
+
+	down := p.upstreams[0]
+	down.record(0, errors.New("failed"), p.maxFails)
+
+	p.Exchange(testQuery("example.com.", dnsmessage.TypeA))
+	if calls := atomic.LoadInt32(&a.calls); calls != 0 {
+		t.Fatalf("down upstream queried %d times before its retry", calls)
+	}
+
+	//The retry is due, so the next query goes to the down upstream
+	down.retryAt = time.Now()
+
+	p.Exchange(testQuery("example.com.", dnsmessage.TypeA))
+	if calls := atomic.LoadInt32(&a.calls); calls != 1 {
+		t.Fatalf("down upstream queried %d times after its retry was due, want 1", calls)
+	}
+	if !down.available(time.Now()) || down.down {
+		t.Error("upstream still down after responding to a retry")
+	}
+}
+
+func TestTrackedUpstreamBackoff(t *testing.T) {
+	u := &trackedUpstream{Upstream: &testUpstream{name: "a"}}
+	u.record(0, errors.New("failed"), 1)
+
+	now := u.retryAt.Add(-retryBackoff)
+
+	for _, want := range []time.Duration{retryBackoff, 2 * retryBackoff, 4 * retryBackoff, 8 * retryBackoff} {
+		if u.available(now.Add(want - time.Millisecond)) {
+			t.Fatalf("down upstream retried before %s", want)
+		}
+
+		now = now.Add(want)
+		if !u.available(now) {
+			t.Fatalf("down upstream not retried after %s", want)
+		}
+		if u.available(now) {
+			t.Fatal("more than one query let through for a retry")
+		}
+	}
+
+	u.backoff = maxRetryBackoff
+	u.available(now.Add(maxRetryBackoff))
+	if u.backoff != maxRetryBackoff {
+		t.Errorf("backoff = %s, want at most %s", u.backoff, maxRetryBackoff)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
 	"github.com/tcfw/minidns/metrics"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -17,18 +18,23 @@ const (
 )
 
 func init() {
-	cr := &cacheResolver{
-		cache: map[string]cacheResources{},
-	}
-
 	metrics.GetMetrics().RegisterPluginMetric("cache_records", promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "minidns_cache_count",
 		Help: "Number of records in cache",
 	}))
 
+	RegisterBefore("cache_resolver", newCacheResolver)
+}
+
+func newCacheResolver(_ *viper.Viper) (DNSPlugin, error) {
+	cr := &cacheResolver{
+		cache: map[string]cacheResources{},
+		stop:  make(chan struct{}),
+	}
+
 	go cr.StartGC()
 
-	RegisterBefore(cr)
+	return cr, nil
 }
 
 type cacheResources struct {
@@ -40,6 +46,8 @@ type cacheResources struct {
 type cacheResolver struct {
 	lock  sync.RWMutex
 	cache map[string]cacheResources
+	stop  chan struct{}
+	once  sync.Once
 }
 
 func (cr *cacheResolver) Name() string {
@@ -62,6 +70,7 @@ func (cr *cacheResolver) ServeDNS(h DNSHandler) DNSHandler {
 					cr.lock.Unlock()
 				} else {
 					req.Response = true
+					req.RecursionAvailable = true
 					for _, ans := range cached.answers {
 						ans.Header.TTL = uint32(time.Until(cached.expires).Seconds())
 						req.Answers = append(req.Answers, ans)
@@ -73,7 +82,7 @@ func (cr *cacheResolver) ServeDNS(h DNSHandler) DNSHandler {
 
 		err := h(conn, addr, req)
 
-		if req.Header.Response && len(req.Answers) > 0 {
+		if req.Header.Response && req.Header.RCode == dnsmessage.RCodeSuccess && len(req.Answers) > 0 {
 			cr.lock.Lock()
 			cr.cache[cacheKey] = cacheResources{
 				created: time.Now(),
@@ -89,8 +98,15 @@ func (cr *cacheResolver) ServeDNS(h DNSHandler) DNSHandler {
 
 func (cr *cacheResolver) StartGC() {
 	timer := time.NewTicker(gcDuration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-cr.stop:
+			return
+		}
 
-	for range timer.C {
 		cr.lock.Lock()
 
 		for k, v := range cr.cache {
@@ -102,5 +118,10 @@ func (cr *cacheResolver) StartGC() {
 
 		cr.lock.Unlock()
 	}
+}
 
+//Shutdown stops the GC ticker
+func (cr *cacheResolver) Shutdown() error {
+	cr.once.Do(func() { close(cr.stop) })
+	return nil
 }
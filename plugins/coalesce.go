@@ -0,0 +1,102 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tcfw/minidns/metrics"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+	metrics.GetMetrics().RegisterPluginMetric("coalesced_queries", promauto.NewCounter(prometheus.CounterOpts{
+		Name: "minidns_coalesced_queries",
+		Help: "Number of queries answered by an identical query already in flight upstream",
+	}))
+}
+
+//inflightQuery an upstream query other clients with the same question can wait on
+type inflightQuery struct {
+	done chan struct{}
+	resp *dnsmessage.Message
+}
+
+//queryGroup coalesces identical queries, so while a query is in flight upstream
+//other clients asking the same question wait for its response instead of
+//sending their own query
+type queryGroup struct {
+	mu      sync.Mutex
+	queries map[string]*inflightQuery
+}
+
+func newQueryGroup() *queryGroup {
+	return &queryGroup{queries: map[string]*inflightQuery{}}
+}
+
+//Do calls exchange for the query unless an identical query is already in flight,
+//in which case it waits for and returns that query's response. Responses are
+//shared so must not be changed
+func (g *queryGroup) Do(req *dnsmessage.Message, exchange func() *dnsmessage.Message) *dnsmessage.Message {
+	key, ok := coalesceKey(req)
+	if !ok {
+		return exchange()
+	}
+
+	g.mu.Lock()
+	if q, ok := g.queries[key]; ok {
+		g.mu.Unlock()
+
+		metrics.GetPMetric("coalesced_queries").(prometheus.Counter).Inc()
+		<-q.done
+
+		return q.resp
+	}
+
+	q := &inflightQuery{done: make(chan struct{})}
+	g.queries[key] = q
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.queries, key)
+		g.mu.Unlock()
+
+		close(q.done)
+	}()
+
+	q.resp = exchange()
+
+	return q.resp
+}
+
+//coalesceKey identifies queries which get the same response from upstreams: the
+//question (ignoring case), the RD and CD bits, and the DO bit and EDNS options
+//passed upstream. Only queries with a single question are coalesced
+func coalesceKey(req *dnsmessage.Message) (string, bool) {
+	if len(req.Questions) != 1 {
+		return "", false
+	}
+
+	q := req.Questions[0]
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s/%d/%d/%t/%t", strings.ToLower(q.Name.String()), q.Type, q.Class, req.Header.RecursionDesired, req.Header.CheckingDisabled)
+
+	//Upstream queries always have EDNS, so queries without it are the same as
+	//those without the DO bit or options
+	do, options := false, []dnsmessage.Option{}
+	if edns := ParseEDNS(req); edns != nil {
+		do, options = edns.DO, endToEndOptions(edns.Options)
+	}
+
+	fmt.Fprintf(&key, "/%t", do)
+	for _, opt := range options {
+		fmt.Fprintf(&key, "/%d:%x", opt.Code, opt.Data)
+	}
+
+	return key.String(), true
+}
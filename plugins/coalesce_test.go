@@ -0,0 +1,170 @@
+package plugins
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tcfw/minidns/metrics"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	withEDNS := func(msg *dnsmessage.Message, edns *EDNS) *dnsmessage.Message {
+		SetEDNS(msg, edns)
+		return msg
+	}
+
+	base := testQuery("example.com.", dnsmessage.TypeA)
+	key, ok := coalesceKey(base)
+	if !ok {
+		t.Fatal("coalesceKey() did not coalesce a single question")
+	}
+
+	tests := []struct {
+		name string
+		req  *dnsmessage.Message
+		same bool
+	}{
+		{"other ID", testQuery("example.com.", dnsmessage.TypeA), true},
+		{"case", testQuery("EXAMPLE.com.", dnsmessage.TypeA), true},
+		{"EDNS without DO or options", withEDNS(testQuery("example.com.", dnsmessage.TypeA), &EDNS{UDPSize: 4096}), true},
+		{"hop by hop option", withEDNS(testQuery("example.com.", dnsmessage.TypeA), &EDNS{UDPSize: 1232, Options: []dnsmessage.Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}), true},
+		{"name", testQuery("example.org.", dnsmessage.TypeA), false},
+		{"type", testQuery("example.com.", dnsmessage.TypeAAAA), false},
+		{"DO bit", withEDNS(testQuery("example.com.", dnsmessage.TypeA), &EDNS{UDPSize: 4096, DO: true}), false},
+		{"end to end option", withEDNS(testQuery("example.com.", dnsmessage.TypeA), &EDNS{UDPSize: 4096, Options: []dnsmessage.Option{{Code: 8, Data: []byte{0, 1, 24, 0, 192, 0, 2}}}}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := coalesceKey(tt.req)
+			if !ok {
+				t.Fatal("coalesceKey() did not coalesce a single question")
+			}
+
+			if (got == key) != tt.same {
+				t.Errorf("coalesceKey() = %q, base key %q, want same %t", got, key, tt.same)
+			}
+		})
+	}
+
+	t.Run("RD bit", func(t *testing.T) {
+		req := testQuery("example.com.", dnsmessage.TypeA)
+		req.Header.RecursionDesired = false
+		if got, _ := coalesceKey(req); got == key {
+			t.Error("coalesceKey() ignored the RD bit")
+		}
+	})
+
+	t.Run("CD bit", func(t *testing.T) {
+		req := testQuery("example.com.", dnsmessage.TypeA)
+		req.Header.CheckingDisabled = true
+		if got, _ := coalesceKey(req); got == key {
+			t.Error("coalesceKey() ignored the CD bit")
+		}
+	})
+
+	t.Run("multiple questions", func(t *testing.T) {
+		req := testQuery("example.com.", dnsmessage.TypeA)
+		req.Questions = append(req.Questions, req.Questions[0])
+		if _, ok := coalesceKey(req); ok {
+			t.Error("coalesceKey() coalesced a query with multiple questions")
+		}
+	})
+}
+
+func coalescedCount(t *testing.T) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	if err := metrics.GetPMetric("coalesced_queries").(prometheus.Counter).Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+func TestQueryGroupDo(t *testing.T) {
+	g := newQueryGroup()
+	before := coalescedCount(t)
+
+	var calls int32
+	release := make(chan struct{})
+	exchange := func() *dnsmessage.Message {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return testResponse(testQuery("example.com.", dnsmessage.TypeA))
+	}
+
+	const clients = 10
+	responses := make([]*dnsmessage.Message, clients)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = g.Do(testQuery("example.com.", dnsmessage.TypeA), exchange)
+		}(i)
+	}
+
+	//Wait for every client but the one querying upstream to join the query
+	deadline := time.Now().Add(5 * time.Second)
+	for coalescedCount(t)-before < clients-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %d clients coalesced", coalescedCount(t)-before, clients-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//A different question is not coalesced with the query in flight
+	other := g.Do(testQuery("example.org.", dnsmessage.TypeA), func() *dnsmessage.Message {
+		return testResponse(testQuery("example.org.", dnsmessage.TypeA))
+	})
+	if other.Questions[0].Name.String() != "example.org." {
+		t.Errorf("Do() for another question = %s", other.Questions[0].Name)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("exchange called %d times, want 1", got)
+	}
+	for i, resp := range responses {
+		if resp != responses[0] {
+			t.Errorf("client %d got a different response", i)
+		}
+	}
+
+	if len(g.queries) != 0 {
+		t.Errorf("%d queries left in flight", len(g.queries))
+	}
+
+	//Once complete, the next identical query goes upstream again
+	g.Do(testQuery("example.com.", dnsmessage.TypeA), exchange)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("exchange called %d times after the query completed, want 2", got)
+	}
+}
+
+func TestQueryGroupDoMultipleQuestions(t *testing.T) {
+	g := newQueryGroup()
+
+	req := testQuery("example.com.", dnsmessage.TypeA)
+	req.Questions = append(req.Questions, req.Questions[0])
+
+	var calls int32
+	g.Do(req, func() *dnsmessage.Message {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	if calls != 1 || len(g.queries) != 0 {
+		t.Errorf("exchange called %d times with %d queries in flight, want 1 and 0", calls, len(g.queries))
+	}
+}
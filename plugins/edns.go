@@ -0,0 +1,177 @@
+package plugins
+
+import (
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	//MinUDPSize is the largest UDP payload a client without EDNS(0) can receive (RFC 1035)
+	MinUDPSize = 512
+
+	//MaxUDPSize is the largest possible DNS message over UDP
+	MaxUDPSize = 65535
+
+	//RCodeBadVers extended RCode when the EDNS version is not supported (RFC 6891)
+	RCodeBadVers = 16
+
+	ednsDOBit = 0x8000
+)
+
+//EDNS option codes which are only meaningful between two hops and so shouldn't be
+//passed through to or from upstreams
+var hopByHopOptions = map[uint16]bool{
+	10: true, //COOKIE - RFC 7873
+	11: true, //edns-tcp-keepalive - RFC 7828
+	12: true, //Padding - RFC 7830
+}
+
+//EDNS holds the values of an OPT pseudo-record (RFC 6891)
+type EDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	DO            bool
+	Options       []dnsmessage.Option
+}
+
+//ParseEDNS returns the values of the first OPT record in the additional section or
+//nil if the message doesn't use EDNS(0)
+func ParseEDNS(msg *dnsmessage.Message) *EDNS {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+
+		edns := &EDNS{
+			UDPSize:       uint16(rr.Header.Class),
+			ExtendedRCode: uint8(rr.Header.TTL >> 24),
+			Version:       uint8(rr.Header.TTL >> 16),
+			DO:            rr.Header.TTL&ednsDOBit != 0,
+		}
+
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			edns.Options = append(edns.Options, opt.Options...)
+		}
+
+		return edns
+	}
+
+	return nil
+}
+
+//CountEDNS returns the number of OPT records in the message
+func CountEDNS(msg *dnsmessage.Message) int {
+	count := 0
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			count++
+		}
+	}
+
+	return count
+}
+
+//RemoveEDNS removes all OPT records from the message
+func RemoveEDNS(msg *dnsmessage.Message) {
+	additionals := msg.Additionals[:0]
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+
+	msg.Additionals = additionals
+}
+
+//SetEDNS replaces any OPT record in the message with one holding the given values
+func SetEDNS(msg *dnsmessage.Message, edns *EDNS) {
+	RemoveEDNS(msg)
+
+	ttl := uint32(edns.ExtendedRCode)<<24 | uint32(edns.Version)<<16
+	if edns.DO {
+		ttl |= ednsDOBit
+	}
+
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeOPT,
+			Class: dnsmessage.Class(edns.UDPSize),
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.OPTResource{Options: edns.Options},
+	})
+}
+
+//ServerUDPSize the UDP payload size advertised to clients and upstreams
+func ServerUDPSize() uint16 {
+	size := viper.GetInt("edns_udp_size")
+	if size < MinUDPSize {
+		return MinUDPSize
+	}
+	if size > MaxUDPSize {
+		return MaxUDPSize
+	}
+
+	return uint16(size)
+}
+
+//ClientUDPSize the largest UDP response the client of the query can accept
+func ClientUDPSize(edns *EDNS) int {
+	if edns == nil || edns.UDPSize < MinUDPSize {
+		return MinUDPSize
+	}
+
+	return int(edns.UDPSize)
+}
+
+//SetResponseEDNS sets the OPT record of the response based on the query's EDNS
+//values. Options set by plugins or upstreams are kept, excluding hop-by-hop options.
+//Clients not using EDNS(0) get no OPT record
+func SetResponseEDNS(resp *dnsmessage.Message, query *EDNS) {
+	if query == nil {
+		RemoveEDNS(resp)
+		return
+	}
+
+	edns := &EDNS{
+		UDPSize: ServerUDPSize(),
+		DO:      query.DO,
+	}
+
+	if current := ParseEDNS(resp); current != nil {
+		edns.ExtendedRCode = current.ExtendedRCode
+		edns.Options = endToEndOptions(current.Options)
+	}
+
+	SetEDNS(resp, edns)
+}
+
+//upstreamQuery copies the request for sending upstream, advertising our own UDP
+//payload size while passing through the client's DO bit and EDNS options
+func upstreamQuery(req *dnsmessage.Message) *dnsmessage.Message {
+	query := *req
+	query.Additionals = append([]dnsmessage.Resource{}, req.Additionals...)
+
+	edns := &EDNS{UDPSize: ServerUDPSize()}
+	if clientEDNS := ParseEDNS(req); clientEDNS != nil {
+		edns.DO = clientEDNS.DO
+		edns.Options = endToEndOptions(clientEDNS.Options)
+	}
+
+	SetEDNS(&query, edns)
+
+	return &query
+}
+
+func endToEndOptions(options []dnsmessage.Option) []dnsmessage.Option {
+	filtered := []dnsmessage.Option{}
+	for _, opt := range options {
+		if !hopByHopOptions[opt.Code] {
+			filtered = append(filtered, opt)
+		}
+	}
+
+	return filtered
+}
@@ -1,10 +1,7 @@
 package plugins
 
 import (
-	"fmt"
-	"log"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,120 +19,80 @@ func init() {
 		Buckets: prometheus.LinearBuckets(1, 2, 15),
 	}))
 
-	Register(&forwardResolver{
-		wsm: sync.Map{},
-	})
+	Register("forward_resolver", newForwardResolver)
+}
+
+func newForwardResolver(settings *viper.Viper) (DNSPlugin, error) {
+	upstreams, err := newUpstreamRouter(settings.GetStringSlice("forwarders"), "udp", settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardResolver{upstreams: upstreams}, nil
 }
 
 const (
 	upstreamTimeout = 1 * time.Second
 )
 
-type waitResponse struct {
-	msg *dnsmessage.Message
-}
-
 type forwardResolver struct {
-	mu  sync.RWMutex
-	wsm sync.Map
+	upstreams *upstreamRouter
 }
 
 func (forwarder *forwardResolver) Name() string {
 	return "forward_resolver"
 }
 
+//Start probes the health of the upstreams
+func (forwarder *forwardResolver) Start() {
+	forwarder.upstreams.Start()
+}
+
+//Shutdown stops probing the upstreams
+func (forwarder *forwardResolver) Shutdown() error {
+	return forwarder.upstreams.Shutdown()
+}
+
 func (forwarder *forwardResolver) ServeDNS(h DNSHandler) DNSHandler {
 	return func(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) error {
-		if req.Header.Response {
-			forwarder.handleResponse(req)
-		} else {
-			forwarder.forwardAndWait(conn, addr, req)
+		if !req.Header.Response {
+			forwarder.forwardAndWait(req)
 		}
 
 		return h(conn, addr, req)
 	}
 }
 
-func (forwarder *forwardResolver) handleResponse(msg *dnsmessage.Message) {
-	if !msg.Header.Response {
-		return
-	}
-
-	//fanout to each waiter
-	forwarder.wsm.Range(func(k interface{}, waiter interface{}) bool {
-		go func() { waiter.(chan waitResponse) <- waitResponse{msg: msg} }()
-		return true
-	})
-}
-
-func (forwarder *forwardResolver) forwardAndWait(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) {
-	upstreams := viper.GetStringSlice("forwarders")
-	var upstreamAttempt int
-
-	var answers []dnsmessage.Resource
-
+func (forwarder *forwardResolver) forwardAndWait(req *dnsmessage.Message) {
 	sTime := time.Now()
 
-upstreamL:
-	for upstreamAttempt < len(upstreams) {
-		done := make(chan []dnsmessage.Resource)
-		go func() {
-			timeout := time.Now().Add(5 * time.Second)
-			waitKey := fmt.Sprintf("%d", req.ID)
-			defer func() {
-				forwarder.wsm.Delete(waitKey)
-				close(done)
-			}()
-
-			waiter := make(chan waitResponse)
-			forwarder.wsm.Store(waitKey, waiter)
-
-			for {
-				if time.Now().After(timeout) {
-					return
-				}
-
-				response := <-waiter
-				if !response.msg.Header.Response {
-					continue
-				}
-
-				if response.msg.Questions[0] == req.Questions[0] {
-					done <- response.msg.Answers
-					return
-				}
-			}
-		}()
-
-		addr := &net.UDPAddr{
-			IP:   net.ParseIP(upstreams[upstreamAttempt]),
-			Port: 53,
-		}
-
-		forwarder.forwardOne(conn, addr, req)
-
-		select {
-		case upstreamAnswer := <-done:
-			answers = upstreamAnswer
-			break upstreamL
-		case <-time.After(upstreamTimeout):
-			upstreamAttempt++
-			log.Println("upstream timed out")
-		}
-	}
+	resp := forwarder.upstreams.Exchange(req)
 
 	metrics.GetPMetric("forwader_latency").(prometheus.Histogram).Observe(float64(time.Since(sTime).Milliseconds()))
 
-	req.Header.Response = true
-	if len(answers) > 0 {
-		req.Answers = append(req.Answers, answers...)
-	}
+	setUpstreamResponse(req, resp)
 }
 
-func (forwarder *forwardResolver) forwardOne(conn net.PacketConn, addr *net.UDPAddr, req *dnsmessage.Message) {
-	bytes, _ := req.Pack()
-	n, err := conn.WriteTo(bytes, addr)
-	if err != nil || n == 0 {
-		log.Printf("failed to forward request: %s\n", err)
+//setUpstreamResponse turns the request into the upstream's response, keeping the
+//client's ID and RD and CD bits. Without a response from any upstream the client
+//gets SERVFAIL. The OPT record is rebuilt for the client by SetResponseEDNS
+func setUpstreamResponse(req *dnsmessage.Message, resp *dnsmessage.Message) {
+	req.Header.Response = true
+	req.Header.RecursionAvailable = true
+	req.Header.Truncated = false
+
+	if resp == nil {
+		req.Header.RCode = dnsmessage.RCodeServerFailure
+		return
 	}
+
+	req.Header.RCode = resp.Header.RCode
+	req.Header.Authoritative = resp.Header.Authoritative
+	req.Header.AuthenticData = resp.Header.AuthenticData
+
+	//The response may be shared by coalesced queries, so each gets its own
+	//copy of the sections to change
+	req.Answers = append([]dnsmessage.Resource(nil), resp.Answers...)
+	req.Authorities = append([]dnsmessage.Resource(nil), resp.Authorities...)
+	req.Additionals = append([]dnsmessage.Resource(nil), resp.Additionals...)
 }
@@ -0,0 +1,182 @@
+package plugins
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/spf13/viper"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//DefaultView the view used by listeners which don't set one. Unless configured
+//in views it runs all registered plugins which haven't been disabled
+const DefaultView = "default"
+
+//Pipeline an ordered chain of plugins compiled for a view
+type Pipeline struct {
+	name    string
+	plugins []DNSPlugin
+	chain   DNSHandler
+}
+
+//viewConfig a single entry of the views config
+type viewConfig struct {
+	Plugins []pluginConfig `mapstructure:"plugins"`
+}
+
+//pluginConfig a plugin in a view's pipeline. Settings override the global config
+//for this instance only. Plugins with the same name and share name are created
+//once and reused by each view, sharing their data such as blocklists and cache
+type pluginConfig struct {
+	Name     string                 `mapstructure:"name"`
+	Share    string                 `mapstructure:"share"`
+	Settings map[string]interface{} `mapstructure:"settings"`
+}
+
+var (
+	views = map[string]*Pipeline{}
+
+	//shared plugin instances keyed by plugin name and share name
+	shared = map[string]DNSPlugin{}
+
+	//instances all created plugin instances, for ready and shutdown hooks
+	instances []DNSPlugin
+)
+
+//Setup compiles the pipeline of the default view and each configured view
+func Setup() error {
+	cfgs := map[string]viewConfig{}
+	if err := viper.UnmarshalKey("views", &cfgs); err != nil {
+		return fmt.Errorf("failed to parse views: %s", err)
+	}
+
+	if _, ok := cfgs[DefaultView]; !ok {
+		cfgs[DefaultView] = defaultViewConfig()
+	}
+
+	//Build views in a stable order so the first to declare a shared plugin is
+	//always the one whose settings are used
+	names := make([]string, 0, len(cfgs))
+	for name := range cfgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p, err := newPipeline(name, cfgs[name])
+		if err != nil {
+			return err
+		}
+		views[name] = p
+	}
+
+	return nil
+}
+
+//View gets the compiled pipeline of the view, or nil if there is no such view
+func View(name string) *Pipeline {
+	return views[name]
+}
+
+//defaultViewConfig all registered plugins not disabled, sharing their instances
+//with views which use the default share name
+func defaultViewConfig() viewConfig {
+	cfg := viewConfig{}
+
+	for _, r := range registered {
+		if isPluginDisabled(r.name) {
+			continue
+		}
+
+		cfg.Plugins = append(cfg.Plugins, pluginConfig{Name: r.name, Share: DefaultView})
+	}
+
+	return cfg
+}
+
+func newPipeline(name string, cfg viewConfig) (*Pipeline, error) {
+	p := &Pipeline{name: name}
+
+	for _, pc := range cfg.Plugins {
+		plugin, err := newPlugin(pc)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %s", name, err)
+		}
+
+		p.plugins = append(p.plugins, plugin)
+	}
+
+	p.chain = nullHandler
+	for i := len(p.plugins) - 1; i >= 0; i-- {
+		p.chain = p.plugins[i].ServeDNS(p.chain)
+	}
+
+	log.Printf("Compiled view %s: %v", name, p)
+
+	return p, nil
+}
+
+//newPlugin creates the plugin, or reuses the existing instance if shared
+func newPlugin(cfg pluginConfig) (DNSPlugin, error) {
+	key := cfg.Name + "/" + cfg.Share
+	if cfg.Share != "" {
+		if plugin, ok := shared[key]; ok {
+			return plugin, nil
+		}
+	}
+
+	var factory Factory
+	for _, r := range registered {
+		if r.name == cfg.Name {
+			factory = r.factory
+			break
+		}
+	}
+	if factory == nil {
+		return nil, fmt.Errorf("unknown plugin %q", cfg.Name)
+	}
+
+	plugin, err := factory(pluginSettings(cfg.Settings))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plugin %s: %s", cfg.Name, err)
+	}
+
+	instances = append(instances, plugin)
+	if cfg.Share != "" {
+		shared[key] = plugin
+	}
+
+	return plugin, nil
+}
+
+//pluginSettings the global config with the overrides applied
+func pluginSettings(overrides map[string]interface{}) *viper.Viper {
+	if len(overrides) == 0 {
+		return viper.GetViper()
+	}
+
+	settings := viper.New()
+	for k, v := range viper.AllSettings() {
+		settings.SetDefault(k, v)
+	}
+	settings.MergeConfigMap(overrides)
+
+	return settings
+}
+
+//ChainRequest runs the DNS request through each plugin of the pipeline
+func (p *Pipeline) ChainRequest(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) error {
+	return p.chain(conn, addr, req)
+}
+
+func (p *Pipeline) String() string {
+	names := make([]string, 0, len(p.plugins))
+	for _, plugin := range p.plugins {
+		names = append(names, plugin.Name())
+	}
+
+	return fmt.Sprintf("%v", names)
+}
@@ -3,13 +3,15 @@ package plugins
 import (
 	"log"
 	"net"
+	"sync"
 
 	"github.com/spf13/viper"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-//DNSHandler main func type implemented by plugins to handle DNS requests
+//DNSHandler main func type implemented by plugins to handle DNS requests. The conn
+//is the UDP socket the request was received on, or nil for other transports
 type DNSHandler func(net.PacketConn, net.Addr, *dnsmessage.Message) error
 
 //DNSPlugin basic plugin interface
@@ -18,7 +20,32 @@ type DNSPlugin interface {
 	ServeDNS(DNSHandler) DNSHandler
 }
 
-var plugins []DNSPlugin
+//Starter is implemented by plugins which run in the background, such as fetching
+//remote data. Start is called once after privileges have been dropped
+type Starter interface {
+	Start()
+}
+
+//Readier is implemented by plugins which need time to load before being fully functional
+type Readier interface {
+	Ready() <-chan struct{}
+}
+
+//Shutdowner is implemented by plugins which need to clean up when the server stops
+type Shutdowner interface {
+	Shutdown() error
+}
+
+//Factory creates a new instance of a plugin using the given settings
+type Factory func(settings *viper.Viper) (DNSPlugin, error)
+
+type registration struct {
+	name    string
+	factory Factory
+}
+
+//registered plugin factories in the order plugins run in the default view
+var registered []registration
 
 var nullHandler = func(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) error {
 	//Update response to true so handler sends a no-answer response
@@ -27,31 +54,55 @@ var nullHandler = func(conn net.PacketConn, addr net.Addr, req *dnsmessage.Messa
 	return nil
 }
 
-//ChainRequest chains each DNS request to each plugin as registered
-func ChainRequest(conn net.PacketConn, addr net.Addr, req *dnsmessage.Message) error {
-	chain := nullHandler
+//Register appends a new plugin
+func Register(name string, factory Factory) {
+	registered = append(registered, registration{name: name, factory: factory})
+	log.Printf("Registered plugin: %s", name)
+}
+
+//RegisterBefore prepends a new plugin to ensure it's run first
+func RegisterBefore(name string, factory Factory) {
+	registered = append([]registration{{name: name, factory: factory}}, registered...)
+	log.Printf("Registered plugin: %s", name)
+}
+
+var startOnce sync.Once
 
-	for i := len(plugins) - 1; i >= 0; i-- {
-		if isPluginDisabled(plugins[i].Name()) {
+//Start starts the background work of each plugin instance
+func Start() {
+	startOnce.Do(func() {
+		for _, plugin := range instances {
+			if s, ok := plugin.(Starter); ok {
+				go s.Start()
+			}
+		}
+	})
+}
+
+//WaitReady blocks until all plugin instances are ready
+func WaitReady() {
+	for _, plugin := range instances {
+		r, ok := plugin.(Readier)
+		if !ok {
 			continue
 		}
 
-		chain = plugins[i].ServeDNS(chain)
+		<-r.Ready()
 	}
-
-	return chain(conn, addr, req)
 }
 
-//Register appends a new plugin
-func Register(plugin DNSPlugin) {
-	plugins = append(plugins, plugin)
-	log.Printf("Registered plugin: %s", plugin.Name())
-}
+//Shutdown calls the shutdown hook of each plugin instance
+func Shutdown() {
+	for _, plugin := range instances {
+		s, ok := plugin.(Shutdowner)
+		if !ok {
+			continue
+		}
 
-//RegisterBefore prepends a new plugin to ensure it's run first
-func RegisterBefore(plugin DNSPlugin) {
-	plugins = append([]DNSPlugin{plugin}, plugins...)
-	log.Printf("Registered plugin: %s", plugin.Name())
+		if err := s.Shutdown(); err != nil {
+			log.Printf("failed to shutdown plugin %s: %s\n", plugin.Name(), err)
+		}
+	}
 }
 
 func isPluginDisabled(name string) bool {
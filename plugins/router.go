@@ -0,0 +1,150 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//forwardZone an entry of the forward_zones config, sending queries for names in
+//the zones to their own upstreams
+type forwardZone struct {
+	Zones     []string `mapstructure:"zones"`
+	Upstreams []string `mapstructure:"upstreams"`
+}
+
+//upstreamRouter picks the upstreams for a query by the longest zone matching the
+//question's name, using the default upstreams when no zone matches
+type upstreamRouter struct {
+	zones    map[string]*upstreamPool
+	fallback *upstreamPool
+	pools    []*upstreamPool
+	inflight *queryGroup
+}
+
+//newUpstreamRouter creates the pools for the default upstreams and each of the
+//forward_zones in the settings. Zone upstreams without a scheme are plain DNS
+//over UDP whatever the forwarder's default scheme, as split DNS is mostly used
+//to reach local and VPN resolvers
+func newUpstreamRouter(upstreams []string, defaultScheme string, settings *viper.Viper) (*upstreamRouter, error) {
+	r := &upstreamRouter{
+		zones:    map[string]*upstreamPool{},
+		inflight: newQueryGroup(),
+	}
+
+	var err error
+	r.fallback, err = r.newPool(upstreams, defaultScheme, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []forwardZone{}
+	if err := settings.UnmarshalKey("forward_zones", &zones); err != nil {
+		return nil, fmt.Errorf("failed to parse forward_zones: %s", err)
+	}
+
+	for _, zone := range zones {
+		if len(zone.Upstreams) == 0 {
+			return nil, fmt.Errorf("forward zones %v have no upstreams", zone.Zones)
+		}
+
+		pool, err := r.newPool(zone.Upstreams, "udp", settings)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range zone.Zones {
+			name = canonicalZone(name)
+			if _, ok := r.zones[name]; ok {
+				return nil, fmt.Errorf("forward zone %s is listed more than once", name)
+			}
+			r.zones[name] = pool
+		}
+	}
+
+	return r, nil
+}
+
+func (r *upstreamRouter) newPool(upstreams []string, defaultScheme string, settings *viper.Viper) (*upstreamPool, error) {
+	parsed, err := parseUpstreams(upstreams, defaultScheme)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := newUpstreamPool(parsed, settings)
+	if err != nil {
+		return nil, err
+	}
+	r.pools = append(r.pools, pool)
+
+	return pool, nil
+}
+
+//Exchange sends the query to the upstreams of the longest matching zone, unless
+//the same query is already in flight. The response may be shared with other
+//clients so must not be changed
+func (r *upstreamRouter) Exchange(req *dnsmessage.Message) *dnsmessage.Message {
+	return r.inflight.Do(req, func() *dnsmessage.Message {
+		if len(req.Questions) == 0 {
+			return r.fallback.Exchange(req)
+		}
+
+		return r.route(req.Questions[0].Name.String()).Exchange(req)
+	})
+}
+
+//route finds the pool for the name, trying the name then each parent zone
+func (r *upstreamRouter) route(name string) *upstreamPool {
+	name = canonicalZone(name)
+
+	for {
+		if pool, ok := r.zones[name]; ok {
+			return pool
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+
+	if pool, ok := r.zones[""]; ok {
+		return pool
+	}
+
+	return r.fallback
+}
+
+//Start probes the health of the upstreams of each pool
+func (r *upstreamRouter) Start() {
+	var wg sync.WaitGroup
+
+	for _, pool := range r.pools {
+		wg.Add(1)
+		go func(pool *upstreamPool) {
+			defer wg.Done()
+			pool.Start()
+		}(pool)
+	}
+
+	wg.Wait()
+}
+
+//Shutdown stops probing the upstreams
+func (r *upstreamRouter) Shutdown() error {
+	for _, pool := range r.pools {
+		pool.Shutdown()
+	}
+
+	return nil
+}
+
+//canonicalZone lower cases the name and removes the trailing dot, so the root
+//zone is an empty string
+func canonicalZone(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
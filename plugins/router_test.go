@@ -0,0 +1,79 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func newTestRouter(t *testing.T, defaultScheme string) *upstreamRouter {
+	t.Helper()
+
+	settings := viper.New()
+	settings.Set("upstream_strategy", strategySequential)
+	settings.Set("forward_zones", []map[string]interface{}{
+		{"zones": []string{"corp.example.com", "10.in-addr.arpa."}, "upstreams": []string{"10.8.0.53"}},
+		{"zones": []string{"dev.corp.example.com"}, "upstreams": []string{"10.8.1.53"}},
+		{"zones": []string{"Home.Arpa"}, "upstreams": []string{"192.168.1.1"}},
+	})
+
+	r, err := newUpstreamRouter([]string{"1.1.1.1"}, defaultScheme, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestUpstreamRouterRoute(t *testing.T) {
+	r := newTestRouter(t, "udp")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.example.com.", "udp://10.8.0.53:53"},
+		{"www.corp.example.com.", "udp://10.8.0.53:53"},
+		{"WWW.Corp.Example.com.", "udp://10.8.0.53:53"},
+		{"dev.corp.example.com.", "udp://10.8.1.53:53"},
+		{"api.dev.corp.example.com.", "udp://10.8.1.53:53"},
+		{"1.0.0.10.in-addr.arpa.", "udp://10.8.0.53:53"},
+		{"router.home.arpa.", "udp://192.168.1.1:53"},
+		{"notcorp.example.com.", "udp://1.1.1.1:53"},
+		{"example.com.", "udp://1.1.1.1:53"},
+		{".", "udp://1.1.1.1:53"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.route(tt.name).upstreams[0].String(); got != tt.want {
+				t.Errorf("route(%s) = %s, want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamRouterZoneScheme(t *testing.T) {
+	r := newTestRouter(t, "https")
+
+	if got, want := r.route("example.com.").upstreams[0].String(), "https://1.1.1.1/dns-query"; got != want {
+		t.Errorf("default upstream = %s, want %s", got, want)
+	}
+
+	if got, want := r.route("router.home.arpa.").upstreams[0].String(), "udp://192.168.1.1:53"; got != want {
+		t.Errorf("zone upstream = %s, want %s", got, want)
+	}
+}
+
+func TestUpstreamRouterDuplicateZone(t *testing.T) {
+	settings := viper.New()
+	settings.Set("upstream_strategy", strategySequential)
+	settings.Set("forward_zones", []map[string]interface{}{
+		{"zones": []string{"home.arpa"}, "upstreams": []string{"192.168.1.1"}},
+		{"zones": []string{"HOME.arpa."}, "upstreams": []string{"192.168.1.2"}},
+	})
+
+	if _, err := newUpstreamRouter([]string{"1.1.1.1"}, "udp", settings); err == nil {
+		t.Error("newUpstreamRouter() accepted a zone listed twice")
+	}
+}
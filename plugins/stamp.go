@@ -0,0 +1,175 @@
+package plugins
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//DNS stamp protocols (https://dnscrypt.info/stamps-specifications)
+const (
+	stampPlain    = 0x00
+	stampDNSCrypt = 0x01
+	stampDoH      = 0x02
+	stampDoT      = 0x03
+	stampDoQ      = 0x04
+)
+
+//stampReader reads the fields of a decoded stamp
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+//lp reads a length prefixed field
+func (r *stampReader) lp() []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = fmt.Errorf("stamp too short")
+		return nil
+	}
+
+	v := r.b[1 : 1+int(r.b[0])]
+	r.b = r.b[1+int(r.b[0]):]
+
+	return v
+}
+
+//vlp reads a set of length prefixed fields, where the high bit of the length
+//is set when more fields follow
+func (r *stampReader) vlp() [][]byte {
+	var vs [][]byte
+
+	for r.err == nil {
+		if len(r.b) < 1 {
+			r.err = fmt.Errorf("stamp too short")
+			return nil
+		}
+
+		more := r.b[0]&0x80 != 0
+		l := int(r.b[0] & 0x7f)
+		if len(r.b) < 1+l {
+			r.err = fmt.Errorf("stamp too short")
+			return nil
+		}
+
+		if l > 0 {
+			vs = append(vs, r.b[1:1+l])
+		}
+		r.b = r.b[1+l:]
+
+		if !more {
+			break
+		}
+	}
+
+	return vs
+}
+
+//parseStamp creates the upstream described by an sdns:// stamp. Stamps for
+//encrypted protocols may give an IP address to connect to as well as the
+//hostname used for TLS
+func parseStamp(s string) (Upstream, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, err)
+	}
+
+	//Protocol followed by 8 bytes of properties (DNSSEC, no logs, no filter)
+	//which are informational only
+	if len(b) < 9 {
+		return nil, fmt.Errorf("invalid stamp %s: too short", s)
+	}
+	r := &stampReader{b: b[9:]}
+
+	var upstream Upstream
+
+	switch b[0] {
+	case stampPlain:
+		addr := stampAddr(string(r.lp()), dnsPort)
+		upstream = newUDPUpstream(addr)
+	case stampDNSCrypt:
+		addr := stampAddr(string(r.lp()), httpsPort)
+		pk := r.lp()
+		providerName := string(r.lp())
+		if r.err == nil && len(pk) != ed25519.PublicKeySize {
+			r.err = fmt.Errorf("invalid provider key")
+		}
+		upstream = newDNSCryptUpstream(addr, providerName, ed25519.PublicKey(pk))
+	case stampDoH:
+		addr := string(r.lp())
+		hashes := r.vlp()
+		host := string(r.lp())
+		path := string(r.lp())
+
+		dialAddr := ""
+		if addr != "" {
+			dialAddr = stampAddr(addr, stampPort(host, httpsPort))
+		}
+		upstream = newHTTPSUpstream("https://"+host+path, dialAddr, hashes)
+	case stampDoT, stampDoQ:
+		addr := string(r.lp())
+		hashes := r.vlp()
+		host := string(r.lp())
+
+		port := dotPort
+		if b[0] == stampDoQ {
+			port = doqPort
+		}
+		port = stampPort(host, port)
+
+		serverName := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			serverName = h
+		}
+
+		dialAddr := net.JoinHostPort(serverName, port)
+		if addr != "" {
+			dialAddr = stampAddr(addr, port)
+		}
+
+		if b[0] == stampDoT {
+			upstream = newTLSUpstream(dialAddr, serverName, hashes)
+			break
+		}
+
+		dialHost, _, _ := net.SplitHostPort(dialAddr)
+		fallbacks, err := quicFallbacks(dialHost, serverName, hashes, "")
+		if err != nil {
+			return nil, err
+		}
+		upstream = newQUICUpstream(dialAddr, serverName, hashes, fallbacks)
+	default:
+		return nil, fmt.Errorf("invalid stamp %s: unsupported protocol 0x%02x", s, b[0])
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid stamp %s: %s", s, r.err)
+	}
+
+	return upstream, nil
+}
+
+//stampAddr the IP address of a stamp with the port, or the default port if the
+//stamp doesn't give one. IPv6 addresses are in brackets
+func stampAddr(addr string, port string) string {
+	if host, p, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, p)
+	}
+
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+//stampPort the port of a stamp's hostname, or the default port if not given
+func stampPort(host string, port string) string {
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		return p
+	}
+
+	return port
+}
@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+//testStamp encodes an sdns:// stamp for the protocol with no properties set
+func testStamp(protocol byte, fields ...[]byte) string {
+	b := append([]byte{protocol}, make([]byte, 8)...)
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+//stampLP a length prefixed stamp field
+func stampLP(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+//stampVLP a set of length prefixed stamp fields
+func stampVLP(vs ...[]byte) []byte {
+	if len(vs) == 0 {
+		return []byte{0}
+	}
+
+	var b []byte
+	for i, v := range vs {
+		l := byte(len(v))
+		if i < len(vs)-1 {
+			l |= 0x80
+		}
+		b = append(append(b, l), v...)
+	}
+
+	return b
+}
+
+func TestParseStamp(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	providerKey := string(bytes.Repeat([]byte{0x01}, 32))
+
+	tests := []struct {
+		name       string
+		stamp      string
+		want       string
+		serverName string
+		wantErr    bool
+	}{
+		{
+			name:  "plain",
+			stamp: testStamp(stampPlain, stampLP("8.8.8.8")),
+			want:  "udp://8.8.8.8:53",
+		},
+		{
+			name:  "plain IPv6 with port",
+			stamp: testStamp(stampPlain, stampLP("[2001:db8::1]:5353")),
+			want:  "udp://[2001:db8::1]:5353",
+		},
+		{
+			name:  "DNSCrypt",
+			stamp: testStamp(stampDNSCrypt, stampLP("203.0.113.1"), stampLP(providerKey), stampLP("2.dnscrypt-cert.example.com")),
+			want:  "dnscrypt://203.0.113.1:443",
+		},
+		{
+			name:    "DNSCrypt short provider key",
+			stamp:   testStamp(stampDNSCrypt, stampLP("203.0.113.1"), stampLP("short"), stampLP("2.dnscrypt-cert.example.com")),
+			wantErr: true,
+		},
+		{
+			//Cloudflare's published stamp
+			name:  "DoH",
+			stamp: "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+			want:  "https://dns.cloudflare.com/dns-query",
+		},
+		{
+			name:       "DoT by hostname",
+			stamp:      testStamp(stampDoT, stampLP(""), stampVLP(hash), stampLP("dns.example")),
+			want:       "tls://dns.example:853",
+			serverName: "dns.example",
+		},
+		{
+			name:       "DoT by address with port in hostname",
+			stamp:      testStamp(stampDoT, stampLP("192.0.2.1"), stampVLP(hash, hash), stampLP("dns.example:8853")),
+			want:       "tls://192.0.2.1:8853",
+			serverName: "dns.example",
+		},
+		{
+			name:       "DoQ",
+			stamp:      testStamp(stampDoQ, stampLP("192.0.2.1"), stampVLP(), stampLP("dns.example")),
+			want:       "quic://192.0.2.1:853",
+			serverName: "dns.example",
+		},
+		{
+			name:    "truncated",
+			stamp:   testStamp(stampDoT, stampLP("192.0.2.1"), stampVLP(hash)),
+			wantErr: true,
+		},
+		{
+			name:    "too short",
+			stamp:   "sdns://AgcA",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported protocol",
+			stamp:   testStamp(0x05, stampLP("192.0.2.1")),
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			stamp:   "sdns://not a stamp",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := parseStamp(tt.stamp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStamp() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := u.String(); got != tt.want {
+				t.Errorf("parseStamp() = %s, want %s", got, tt.want)
+			}
+
+			var serverName string
+			switch u := u.(type) {
+			case *tlsUpstream:
+				serverName = u.tlsConfig.ServerName
+			case *quicUpstream:
+				serverName = u.tlsConfig.ServerName
+				if len(u.fallbacks) != 2 {
+					t.Errorf("%d QUIC fallbacks, want 2", len(u.fallbacks))
+				}
+			case *dnscryptUpstream:
+				if u.providerName != "2.dnscrypt-cert.example.com" || string(u.providerKey) != providerKey {
+					t.Errorf("provider = %s %x", u.providerName, u.providerKey)
+				}
+			}
+
+			if serverName != tt.serverName {
+				t.Errorf("server name = %q, want %q", serverName, tt.serverName)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//ReadTCPMessage reads a single 2 byte length prefixed DNS message (RFC 1035 section 4.2.2)
+func ReadTCPMessage(r io.Reader) (*dnsmessage.Message, error) {
+	b, err := ReadTCPFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(b); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+//ReadTCPFrame reads a single 2 byte length prefixed message without parsing it
+func ReadTCPFrame(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+//WriteTCPMessage writes the message with a 2 byte length prefix in a single write
+func WriteTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+
+	_, err := w.Write(b)
+	return err
+}
+
+//exchangeTCP sends the query to the upstream over TCP and waits for the response
+func exchangeTCP(addr string, req *dnsmessage.Message, timeout time.Duration) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchangeStream(conn, req, timeout)
+}
+
+//exchangeStream sends the query over a TCP or TLS connection and waits for the response
+func exchangeStream(conn net.Conn, req *dnsmessage.Message, timeout time.Duration) (*dnsmessage.Message, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	query := upstreamQuery(req)
+	query.Header.ID = randomID()
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteTCPMessage(conn, reqBytes); err != nil {
+		return nil, err
+	}
+
+	resp, err := ReadTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isResponseTo(resp, query) {
+		return nil, fmt.Errorf("unexpected response from %s", conn.RemoteAddr())
+	}
+
+	return resp, nil
+}
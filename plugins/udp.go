@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//exchangeUDP sends the query to the upstream from a new socket, so each query
+//gets a random source port as well as a random ID, and waits for the response.
+//Replies which don't match the ID and question are ignored, and the connected
+//socket only accepts replies from the upstream's address
+func exchangeUDP(addr string, req *dnsmessage.Message, timeout time.Duration) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	query := upstreamQuery(req)
+	query.Header.ID = randomID()
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(reqBytes); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, ServerUDPSize())
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := &dnsmessage.Message{}
+		if err := resp.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		if isResponseTo(resp, query) {
+			return resp, nil
+		}
+	}
+}
+
+//isResponseTo checks the message is a response with the same ID and questions as the query
+func isResponseTo(resp *dnsmessage.Message, query *dnsmessage.Message) bool {
+	if !resp.Header.Response || resp.Header.ID != query.Header.ID || len(resp.Questions) != len(query.Questions) {
+		return false
+	}
+
+	for i, q := range query.Questions {
+		rq := resp.Questions[i]
+		if rq.Type != q.Type || rq.Class != q.Class || !strings.EqualFold(rq.Name.String(), q.Name.String()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//randomID an unpredictable message ID for upstream queries
+func randomID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,292 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPort   = "53"
+	dotPort   = "853"
+	doqPort   = "853"
+	httpsPort = "443"
+
+	defaultDoHPath = "/dns-query"
+)
+
+//Upstream a DNS server queries are forwarded to
+type Upstream interface {
+	//Exchange sends the query and waits for the matching response
+	Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error)
+	String() string
+}
+
+//ParseUpstream parses an upstream URL such as udp://10.0.0.1:5353, tcp://,
+//tls://dns.example:853, https://dns.example/dns-query, quic:// or an sdns://
+//stamp. Addresses without a scheme use the default scheme. TLS and QUIC
+//upstreams given by IP can set the server name with ?sni=dns.example
+func ParseUpstream(s string, defaultScheme string) (Upstream, error) {
+	if !strings.Contains(s, "://") {
+		//Bare IPv6 addresses need brackets to be parsed as a host
+		if ip := net.ParseIP(s); ip != nil && strings.Contains(s, ":") {
+			s = "[" + s + "]"
+		}
+		s = defaultScheme + "://" + s
+	}
+
+	if strings.HasPrefix(s, "sdns://") {
+		return parseStamp(s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %s", s, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %s: missing host", s)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return newUDPUpstream(hostPort(u, dnsPort)), nil
+	case "tcp":
+		return newTCPUpstream(hostPort(u, dnsPort)), nil
+	case "tls":
+		return newTLSUpstream(hostPort(u, dotPort), serverName(u), nil), nil
+	case "https":
+		if u.Path == "" {
+			u.Path = defaultDoHPath
+		}
+		return newHTTPSUpstream(u.String(), "", nil), nil
+	case "quic":
+		fallbacks, err := quicFallbacks(u.Hostname(), serverName(u), nil, u.Query().Get("fallback"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %s", s, err)
+		}
+		return newQUICUpstream(hostPort(u, doqPort), serverName(u), nil, fallbacks), nil
+	default:
+		return nil, fmt.Errorf("invalid upstream %s: unknown scheme %s", s, u.Scheme)
+	}
+}
+
+//parseUpstreams parses each of the upstreams
+func parseUpstreams(upstreams []string, defaultScheme string) ([]Upstream, error) {
+	parsed := make([]Upstream, 0, len(upstreams))
+
+	for _, s := range upstreams {
+		u, err := ParseUpstream(s, defaultScheme)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, u)
+	}
+
+	return parsed, nil
+}
+
+//PlainUpstreamAddress the host and port of a plain DNS (UDP or TCP) upstream
+func PlainUpstreamAddress(s string) (string, bool) {
+	u, err := ParseUpstream(s, "udp")
+	if err != nil {
+		return "", false
+	}
+
+	switch u := u.(type) {
+	case *udpUpstream:
+		return u.addr, true
+	case *tcpUpstream:
+		return u.addr, true
+	default:
+		return "", false
+	}
+}
+
+//serverName the name used for SNI and to verify the certificate, which is the
+//sni parameter if set or the host of the URL
+func serverName(u *url.URL) string {
+	if sni := u.Query().Get("sni"); sni != "" {
+		return sni
+	}
+
+	return u.Hostname()
+}
+
+//hostPort the host of the URL with its port, or the default port if not given
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+//udpUpstream plain DNS over UDP, retrying over TCP when the response is truncated
+type udpUpstream struct {
+	addr string
+}
+
+func newUDPUpstream(addr string) *udpUpstream {
+	return &udpUpstream{addr: addr}
+}
+
+func (u *udpUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	resp, err := exchangeUDP(u.addr, req, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Truncated {
+		resp, err = exchangeTCP(u.addr, req, upstreamTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retry truncated response over TCP: %s", err)
+		}
+	}
+
+	return resp, nil
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+//tcpUpstream plain DNS over TCP (RFC 7766)
+type tcpUpstream struct {
+	addr string
+}
+
+func newTCPUpstream(addr string) *tcpUpstream {
+	return &tcpUpstream{addr: addr}
+}
+
+func (u *tcpUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	return exchangeTCP(u.addr, req, upstreamTimeout)
+}
+
+func (u *tcpUpstream) String() string {
+	return "tcp://" + u.addr
+}
+
+//httpsUpstream DNS over HTTPS (RFC 8484)
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+//newHTTPSUpstream creates a DoH upstream, connecting to dialAddr instead of
+//resolving the URL's host if set
+func newHTTPSUpstream(url string, dialAddr string, hashes [][]byte) *httpsUpstream {
+	transport := &http.Transport{
+		MaxIdleConns:      20,
+		IdleConnTimeout:   5 * time.Minute,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   upstreamTLSConfig("", hashes),
+	}
+
+	if dialAddr != "" {
+		d := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, dialAddr)
+		}
+	}
+
+	return &httpsUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   upstreamTimeout,
+		},
+	}
+}
+
+func (u *httpsUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	//The ID should be 0 so responses can be cached by HTTP caches
+	query := upstreamQuery(req)
+	query.Header.ID = 0
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", u.url, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Add("accept", "application/dns-message")
+	httpReq.Header.Add("content-type", "application/dns-message")
+
+	httpResp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch dns response - status code: %d", httpResp.StatusCode)
+	}
+	if ct := httpResp.Header.Get("content-type"); !strings.HasPrefix(ct, "application/dns-message") {
+		return nil, fmt.Errorf("unknown responses type: %s", ct)
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	if !isResponseTo(resp, query) {
+		return nil, fmt.Errorf("unexpected DoH response from %s", u.url)
+	}
+
+	return resp, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+//upstreamTLSConfig verifies the server's certificate as usual and, if any hashes
+//are given (from a stamp), that a certificate in its chain has a matching
+//SHA256 digest of its TBS certificate
+func upstreamTLSConfig(serverName string, hashes [][]byte) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(hashes) == 0 {
+		return tlsConfig
+	}
+
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawTBSCertificate)
+				for _, h := range hashes {
+					if bytes.Equal(digest[:], h) {
+						return nil
+					}
+				}
+			}
+		}
+
+		return fmt.Errorf("no certificate matching the stamp's hashes")
+	}
+
+	return tlsConfig
+}
@@ -0,0 +1,250 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcfw/minidns/dnscrypt"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dnscryptMinUDPQuery UDP queries are padded to at least this size, as resolvers
+//don't send UDP responses larger than the query
+const dnscryptMinUDPQuery = 512
+
+//dnscryptUpstream a DNSCrypt v2 resolver, as given by an sdns:// stamp
+type dnscryptUpstream struct {
+	addr         string
+	providerName string
+	providerKey  ed25519.PublicKey
+
+	mu   sync.Mutex
+	cert *dnscrypt.Cert
+}
+
+func newDNSCryptUpstream(addr string, providerName string, providerKey ed25519.PublicKey) *dnscryptUpstream {
+	return &dnscryptUpstream{
+		addr:         addr,
+		providerName: strings.TrimSuffix(providerName, "."),
+		providerKey:  providerKey,
+	}
+}
+
+func (u *dnscryptUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	cert, err := u.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	query := upstreamQuery(req)
+	query.Header.ID = randomID()
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.exchange(cert, query, reqBytes, "udp")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Truncated {
+		resp, err = u.exchange(cert, query, reqBytes, "tcp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to retry truncated response over TCP: %s", err)
+		}
+	}
+
+	return resp, nil
+}
+
+//exchange encrypts the query with a new key pair and waits for the response.
+//Over UDP, replies which can't be decrypted are ignored
+func (u *dnscryptUpstream) exchange(cert *dnscrypt.Cert, query *dnsmessage.Message, reqBytes []byte, network string) (*dnsmessage.Message, error) {
+	var secretKey, publicKey [32]byte
+	if _, err := io.ReadFull(rand.Reader, secretKey[:]); err != nil {
+		return nil, err
+	}
+	pk, err := curve25519.X25519(secretKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(publicKey[:], pk)
+
+	sharedKey, err := dnscrypt.SharedKey(cert.ES, &secretKey, &cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	//The second half of the query nonce is zero
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:dnscrypt.HalfNonceLen]); err != nil {
+		return nil, err
+	}
+
+	padded := dnscrypt.Pad(reqBytes, MaxUDPSize-dnscrypt.QueryOverhead)
+	if network == "udp" && len(padded)+dnscrypt.QueryOverhead < dnscryptMinUDPQuery {
+		padded = append(padded, make([]byte, dnscryptMinUDPQuery-dnscrypt.QueryOverhead-len(padded))...)
+	}
+
+	packet := append([]byte{}, cert.ClientMagic[:]...)
+	packet = append(packet, publicKey[:]...)
+	packet = append(packet, nonce[:dnscrypt.HalfNonceLen]...)
+	packet = append(packet, dnscrypt.Seal(cert.ES, &sharedKey, &nonce, padded)...)
+
+	conn, err := net.DialTimeout(network, u.addr, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if network == "tcp" {
+		err = WriteTCPMessage(conn, packet)
+	} else {
+		_, err = conn.Write(packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxUDPSize)
+	for {
+		var b []byte
+		if network == "tcp" {
+			if b, err = ReadTCPFrame(conn); err != nil {
+				return nil, err
+			}
+		} else {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			b = buf[:n]
+		}
+
+		resp, err := u.decrypt(cert, &sharedKey, &nonce, b)
+		if err == nil && isResponseTo(resp, query) {
+			return resp, nil
+		}
+
+		if network == "tcp" {
+			if err == nil {
+				err = fmt.Errorf("unexpected response")
+			}
+			return nil, err
+		}
+	}
+}
+
+//decrypt opens a response to the query sent with the nonce
+func (u *dnscryptUpstream) decrypt(cert *dnscrypt.Cert, sharedKey *[32]byte, queryNonce *[24]byte, packet []byte) (*dnsmessage.Message, error) {
+	magicLen := len(dnscrypt.ResolverMagic)
+	if len(packet) < dnscrypt.ResponseOverhead || string(packet[:magicLen]) != dnscrypt.ResolverMagic {
+		return nil, fmt.Errorf("not a DNSCrypt response")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], packet[magicLen:])
+	if !bytes.Equal(nonce[:dnscrypt.HalfNonceLen], queryNonce[:dnscrypt.HalfNonceLen]) {
+		return nil, fmt.Errorf("unexpected DNSCrypt response nonce")
+	}
+
+	padded, err := dnscrypt.Open(cert.ES, sharedKey, &nonce, packet[magicLen+24:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := dnscrypt.Unpad(padded)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(msg); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+//certificate the resolver's current certificate, fetching the certificates
+//again when it has expired
+func (u *dnscryptUpstream) certificate() (*dnscrypt.Cert, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.cert != nil && u.cert.Valid(time.Now()) {
+		return u.cert, nil
+	}
+
+	cert, err := u.fetchCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DNSCrypt certificate: %s", err)
+	}
+	u.cert = cert
+
+	return cert, nil
+}
+
+//fetchCertificate queries the provider name's TXT record, choosing the valid
+//certificate with the highest serial, preferring XChaCha20 for the same serial
+func (u *dnscryptUpstream) fetchCertificate() (*dnscrypt.Cert, error) {
+	name, err := dnsmessage.NewName(u.providerName + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	req := &dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}
+
+	resp, err := newUDPUpstream(u.addr).Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscrypt.Cert
+	now := time.Now()
+
+	for _, answer := range resp.Answers {
+		txt, ok := answer.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+
+		cert, err := dnscrypt.ParseCert([]byte(strings.Join(txt.TXT, "")), u.providerKey)
+		if err != nil || !cert.Valid(now) {
+			continue
+		}
+		if cert.ES != dnscrypt.XSalsa20Poly1305 && cert.ES != dnscrypt.XChacha20Poly1305 {
+			continue
+		}
+
+		if best == nil || cert.Serial > best.Serial || (cert.Serial == best.Serial && cert.ES > best.ES) {
+			best = cert
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no valid certificate for %s", u.providerName)
+	}
+
+	return best, nil
+}
+
+func (u *dnscryptUpstream) String() string {
+	return "dnscrypt://" + u.addr
+}
@@ -0,0 +1,285 @@
+package plugins
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	quicUpstreamKeepAlive   = 15 * time.Second
+	quicUpstreamIdleTimeout = 60 * time.Second
+
+	//quicRetryInterval how long fallbacks are used for after failing to connect
+	//over QUIC, before trying QUIC again
+	quicRetryInterval = 5 * time.Minute
+
+	defaultQUICFallback = "tls,https"
+)
+
+//quicUpstream DNS over QUIC (RFC 9250), sending each query on a new stream of a
+//long-lived connection. Queries are sent in 0-RTT when resuming a session. If
+//QUIC can't connect, e.g. because UDP is blocked, queries are sent to the
+//fallback DoT or DoH upstreams on the same host for a while
+type quicUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+	fallbacks []Upstream
+
+	mu           sync.Mutex
+	conn         *quic.Conn
+	blockedUntil time.Time
+}
+
+func newQUICUpstream(addr string, serverName string, hashes [][]byte, fallbacks []Upstream) *quicUpstream {
+	tlsConfig := upstreamTLSConfig(serverName, hashes)
+	tlsConfig.NextProtos = []string{"doq"}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	return &quicUpstream{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		fallbacks: fallbacks,
+	}
+}
+
+//quicFallbacks the upstreams on the same host used when QUIC is blocked, given
+//by the fallback parameter as a list of "tls" and "https", or "none"
+func quicFallbacks(host string, serverName string, hashes [][]byte, fallback string) ([]Upstream, error) {
+	if fallback == "" {
+		fallback = defaultQUICFallback
+	}
+
+	var fallbacks []Upstream
+
+	for _, scheme := range strings.Split(fallback, ",") {
+		switch scheme {
+		case "none":
+		case "tls":
+			fallbacks = append(fallbacks, newTLSUpstream(net.JoinHostPort(host, dotPort), serverName, hashes))
+		case "https":
+			dialAddr := ""
+			if host != serverName {
+				dialAddr = net.JoinHostPort(host, httpsPort)
+			}
+			urlHost := serverName
+			if strings.Contains(serverName, ":") {
+				//IPv6 literals are bracketed in URLs
+				urlHost = "[" + serverName + "]"
+			}
+			fallbacks = append(fallbacks, newHTTPSUpstream("https://"+urlHost+defaultDoHPath, dialAddr, hashes))
+		default:
+			return nil, fmt.Errorf("unknown QUIC fallback %s", scheme)
+		}
+	}
+
+	return fallbacks, nil
+}
+
+func (u *quicUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if len(u.fallbacks) > 0 && u.isBlocked() {
+		return u.exchangeFallback(req)
+	}
+
+	resp, err := u.exchange(req)
+
+	var dialErr *quicDialError
+	if errors.As(err, &dialErr) && len(u.fallbacks) > 0 {
+		log.Printf("failed to connect to %s, using fallbacks for %s: %s\n", u, quicRetryInterval, dialErr.err)
+
+		u.mu.Lock()
+		u.blockedUntil = time.Now().Add(quicRetryInterval)
+		u.mu.Unlock()
+
+		return u.exchangeFallback(req)
+	}
+
+	return resp, err
+}
+
+//quicDialError failed to establish a QUIC connection
+type quicDialError struct {
+	err error
+}
+
+func (e *quicDialError) Error() string {
+	return e.err.Error()
+}
+
+func (u *quicUpstream) exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	//Message IDs must be 0 as the stream already identifies the query
+	query := upstreamQuery(req)
+	query.Header.ID = 0
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	qc, reused, err := u.connection(ctx)
+	if err != nil {
+		return nil, &quicDialError{err}
+	}
+
+	resp, err := u.exchangeStream(ctx, qc, query, reqBytes)
+	if err != nil && !errors.Is(err, quic.Err0RTTRejected) && !handshakeCompleted(qc, err) {
+		//When resuming, the connection is returned before the server has replied,
+		//so an unreachable server is only noticed once the handshake fails
+		u.closeConnection(qc)
+		return nil, &quicDialError{err}
+	}
+
+	if errors.Is(err, quic.Err0RTTRejected) {
+		//Data sent in 0-RTT was discarded by the server, so resend it once the
+		//handshake completes
+		next, nextErr := qc.NextConnection(ctx)
+		if nextErr != nil {
+			u.closeConnection(qc)
+			return nil, nextErr
+		}
+		u.replaceConnection(next)
+		resp, err = u.exchangeStream(ctx, next, query, reqBytes)
+	} else if err != nil && reused && ctx.Err() == nil {
+		//The connection may have been closed by the server while idle
+		u.closeConnection(qc)
+		if qc, _, err = u.connection(ctx); err != nil {
+			return nil, &quicDialError{err}
+		}
+		resp, err = u.exchangeStream(ctx, qc, query, reqBytes)
+	}
+
+	return resp, err
+}
+
+//exchangeStream sends the query on a new stream and reads the response. Only
+//queries can be sent in 0-RTT as they are safe to replay (RFC 9250 section 4.5)
+func (u *quicUpstream) exchangeStream(ctx context.Context, qc *quic.Conn, query *dnsmessage.Message, reqBytes []byte) (*dnsmessage.Message, error) {
+	if query.Header.OpCode != 0 {
+		select {
+		case <-qc.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	if err := WriteTCPMessage(s, reqBytes); err != nil {
+		s.CancelRead(0)
+		return nil, err
+	}
+	s.Close()
+
+	resp, err := ReadTCPMessage(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isResponseTo(resp, query) {
+		return nil, fmt.Errorf("unexpected DoQ response from %s", u.addr)
+	}
+
+	return resp, nil
+}
+
+//handshakeCompleted checks if the server completed the handshake before the
+//query failed
+func handshakeCompleted(qc *quic.Conn, err error) bool {
+	var timeoutErr *quic.HandshakeTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return false
+	}
+
+	select {
+	case <-qc.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+//exchangeFallback tries each fallback upstream in order
+func (u *quicUpstream) exchangeFallback(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	var err error
+
+	for _, fallback := range u.fallbacks {
+		var resp *dnsmessage.Message
+		if resp, err = fallback.Exchange(req); err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("fallbacks failed: %s", err)
+}
+
+func (u *quicUpstream) isBlocked() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return time.Now().Before(u.blockedUntil)
+}
+
+//connection the current connection to the upstream, dialing a new one if needed.
+//The connection can be used before the handshake completes when resuming
+func (u *quicUpstream) connection(ctx context.Context) (*quic.Conn, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, true, nil
+	}
+
+	qc, err := quic.DialAddrEarly(ctx, u.addr, u.tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: upstreamTimeout / 2,
+		MaxIdleTimeout:       quicUpstreamIdleTimeout,
+		KeepAlivePeriod:      quicUpstreamKeepAlive,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	u.conn = qc
+
+	return qc, false, nil
+}
+
+func (u *quicUpstream) replaceConnection(qc *quic.Conn) {
+	u.mu.Lock()
+	u.conn = qc
+	u.mu.Unlock()
+}
+
+func (u *quicUpstream) closeConnection(qc *quic.Conn) {
+	if qc == nil {
+		return
+	}
+
+	u.mu.Lock()
+	if u.conn == qc {
+		u.conn = nil
+	}
+	u.mu.Unlock()
+
+	qc.CloseWithError(0, "")
+}
+
+func (u *quicUpstream) String() string {
+	return "quic://" + u.addr
+}
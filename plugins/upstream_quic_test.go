@@ -0,0 +1,205 @@
+package plugins
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//testCertificate a self-signed certificate for 127.0.0.1 and the pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "minidns test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+//startTestDoQServer answers DoQ queries with 0-RTT enabled until closed
+func startTestDoQServer(t *testing.T, cert tls.Certificate) *quic.EarlyListener {
+	t.Helper()
+
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			qc, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			go func() {
+				for {
+					s, err := qc.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+
+					req, err := ReadTCPMessage(s)
+					if err != nil {
+						s.CancelRead(0)
+						continue
+					}
+
+					b, _ := testResponse(req).Pack()
+					WriteTCPMessage(s, b)
+					s.Close()
+				}
+			}()
+		}
+	}()
+
+	return ln
+}
+
+//unreachableUDPAddr an address nothing is listening on
+func unreachableUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+func TestQUICUpstreamFallback(t *testing.T) {
+	cert, roots := testCertificate(t)
+
+	tests := []struct {
+		name string
+
+		//resume first queries a server at the address which is then stopped, so
+		//the next connection is resumed with 0-RTT
+		resume bool
+	}{
+		{"unreachable", false},
+		{"unreachable when resuming", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallback := &testUpstream{name: "fallback"}
+
+			addr := unreachableUDPAddr(t)
+			var ln *quic.EarlyListener
+			if tt.resume {
+				ln = startTestDoQServer(t, cert)
+				addr = ln.Addr().String()
+			}
+
+			u := newQUICUpstream(addr, "127.0.0.1", nil, []Upstream{fallback})
+			u.tlsConfig.RootCAs = roots
+
+			if tt.resume {
+				if _, err := u.Exchange(testQuery("example.com.", dnsmessage.TypeA)); err != nil {
+					t.Fatalf("failed to query the server: %s", err)
+				}
+				if atomic.LoadInt32(&fallback.calls) != 0 {
+					t.Fatal("fallback used while the server was reachable")
+				}
+
+				//Wait for the session ticket sent after the handshake
+				time.Sleep(100 * time.Millisecond)
+				ln.Close()
+				u.closeConnection(u.conn)
+			}
+
+			resp, err := u.Exchange(testQuery("example.com.", dnsmessage.TypeA))
+			if err != nil {
+				t.Fatalf("Exchange() error = %v, want the fallback's response", err)
+			}
+			if !resp.Header.Response {
+				t.Error("Exchange() did not return a response")
+			}
+
+			if calls := atomic.LoadInt32(&fallback.calls); calls != 1 {
+				t.Errorf("fallback called %d times, want 1", calls)
+			}
+			if !u.isBlocked() {
+				t.Error("QUIC not skipped after failing to connect")
+			}
+		})
+	}
+}
+
+func TestParseQUICFallbacks(t *testing.T) {
+	tests := []struct {
+		upstream string
+		want     []string
+		wantErr  bool
+	}{
+		{"quic://dns.example", []string{"tls://dns.example:853", "https://dns.example/dns-query"}, false},
+		{"quic://dns.example?fallback=https", []string{"https://dns.example/dns-query"}, false},
+		{"quic://192.0.2.1?sni=dns.example&fallback=tls", []string{"tls://192.0.2.1:853"}, false},
+		{"quic://[2606:4700::1111]", []string{"tls://[2606:4700::1111]:853", "https://[2606:4700::1111]/dns-query"}, false},
+		{"quic://dns.example?fallback=none", nil, false},
+		{"quic://dns.example?fallback=ftp", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			u, err := ParseUpstream(tt.upstream, "udp")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUpstream() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var got []string
+			for _, fallback := range u.(*quicUpstream).fallbacks {
+				got = append(got, fallback.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fallbacks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//testUpstream answers every query itself, or fails if err is set
+type testUpstream struct {
+	name  string
+	err   error
+	calls int32
+}
+
+func (u *testUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	atomic.AddInt32(&u.calls, 1)
+
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	return testResponse(req), nil
+}
+
+func (u *testUpstream) String() string {
+	return u.name
+}
+
+func testQuery(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: randomID(), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+}
+
+func testResponse(req *dnsmessage.Message) *dnsmessage.Message {
+	resp := *req
+	resp.Header.Response = true
+	resp.Header.RecursionAvailable = true
+
+	return &resp
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		upstream      string
+		defaultScheme string
+		want          string
+		wantErr       bool
+	}{
+		{"1.1.1.1", "udp", "udp://1.1.1.1:53", false},
+		{"2606:4700::1111", "udp", "udp://[2606:4700::1111]:53", false},
+		{"tcp://10.0.0.1:5353", "udp", "tcp://10.0.0.1:5353", false},
+		{"tls://1.1.1.1?sni=cloudflare-dns.com", "udp", "tls://1.1.1.1:853", false},
+		{"quic://dns.example", "udp", "quic://dns.example:853", false},
+		{"dns.example", "https", "https://dns.example/dns-query", false},
+		{"https://dns.example/custom", "udp", "https://dns.example/custom", false},
+		{"ftp://dns.example", "udp", "", true},
+		{"udp://", "udp", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			u, err := ParseUpstream(tt.upstream, tt.defaultScheme)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUpstream() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := fmt.Sprint(u); got != tt.want {
+				t.Errorf("ParseUpstream() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	//tlsUpstreamConns most connections open to each DoT upstream
+	tlsUpstreamConns = 2
+
+	//tlsUpstreamPipeline queries sent on a connection before opening another
+	tlsUpstreamPipeline = 64
+
+	//tlsUpstreamIdleTimeout connections without queries for this long are closed
+	tlsUpstreamIdleTimeout = 30 * time.Second
+
+	tlsUpstreamKeepAlive = 15 * time.Second
+)
+
+var errTLSConnClosed = errors.New("connection closed")
+
+//tlsUpstream DNS over TLS (RFC 7858). Queries are pipelined over a small pool of
+//persistent connections and matched to responses by ID, resuming TLS sessions
+//when reconnecting
+type tlsUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	dialMu sync.Mutex
+	conns  []*tlsConn
+}
+
+func newTLSUpstream(addr string, serverName string, hashes [][]byte) *tlsUpstream {
+	tlsConfig := upstreamTLSConfig(serverName, hashes)
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(tlsUpstreamConns)
+
+	return &tlsUpstream{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (u *tlsUpstream) Exchange(req *dnsmessage.Message) (*dnsmessage.Message, error) {
+	deadline := time.Now().Add(upstreamTimeout)
+
+	c, reused, err := u.conn(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(req, deadline)
+	if err == errTLSConnClosed && reused {
+		//The server may have closed the connection while idle
+		if c, _, err = u.conn(deadline); err != nil {
+			return nil, err
+		}
+		resp, err = c.exchange(req, deadline)
+	}
+
+	return resp, err
+}
+
+//conn an open connection with room for another query, dialing a new connection
+//if all are busy and the pool isn't full
+func (u *tlsUpstream) conn(deadline time.Time) (*tlsConn, bool, error) {
+	if c := u.available(); c != nil {
+		return c, true, nil
+	}
+
+	//Only dial one connection at a time, so a burst of queries doesn't open a
+	//connection for each query
+	u.dialMu.Lock()
+	defer u.dialMu.Unlock()
+
+	if c := u.available(); c != nil {
+		return c, true, nil
+	}
+
+	c, err := u.dial(deadline)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u.mu.Lock()
+	u.conns = append(u.conns, c)
+	u.mu.Unlock()
+
+	return c, false, nil
+}
+
+//available the open connection with the fewest queries in flight, or nil if
+//there is none or it is busy and another connection can be opened
+func (u *tlsUpstream) available() *tlsConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var least *tlsConn
+	open := u.conns[:0]
+	for _, c := range u.conns {
+		if c.isClosed() {
+			continue
+		}
+		open = append(open, c)
+
+		if least == nil || c.inFlight() < least.inFlight() {
+			least = c
+		}
+	}
+	u.conns = open
+
+	if least != nil && (least.inFlight() < tlsUpstreamPipeline || len(u.conns) >= tlsUpstreamConns) {
+		return least
+	}
+
+	return nil
+}
+
+func (u *tlsUpstream) dial(deadline time.Time) (*tlsConn, error) {
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Deadline: deadline, KeepAlive: tlsUpstreamKeepAlive},
+		Config:    u.tlsConfig,
+	}
+
+	conn, err := d.Dial("tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tlsConn{
+		conn:    conn,
+		pending: map[uint16]*pendingQuery{},
+		closed:  make(chan struct{}),
+	}
+	go c.readResponses()
+
+	return c, nil
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+//pendingQuery a query waiting for its response on a pipelined connection
+type pendingQuery struct {
+	query *dnsmessage.Message
+	resp  chan *dnsmessage.Message
+}
+
+//tlsConn a connection to a DoT upstream with queries in flight
+type tlsConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	closed  chan struct{}
+}
+
+//exchange sends the query with an ID not in use on the connection and waits
+//for the response
+func (c *tlsConn) exchange(req *dnsmessage.Message, deadline time.Time) (*dnsmessage.Message, error) {
+	query := upstreamQuery(req)
+	pq := &pendingQuery{query: query, resp: make(chan *dnsmessage.Message, 1)}
+
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil, errTLSConnClosed
+	}
+	query.Header.ID = randomID()
+	for c.pending[query.Header.ID] != nil {
+		query.Header.ID = randomID()
+	}
+	c.pending[query.Header.ID] = pq
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, query.Header.ID)
+		c.mu.Unlock()
+	}()
+
+	reqBytes, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	err = WriteTCPMessage(c.conn, reqBytes)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, errTLSConnClosed
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case resp := <-pq.resp:
+		return resp, nil
+	case <-c.closed:
+		return nil, errTLSConnClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for response from %s", c.conn.RemoteAddr())
+	}
+}
+
+//readResponses delivers responses to the pending queries until the connection
+//fails or has been idle for the idle timeout
+func (c *tlsConn) readResponses() {
+	defer c.close()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(tlsUpstreamIdleTimeout))
+
+		resp, err := ReadTCPMessage(c.conn)
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		pq := c.pending[resp.Header.ID]
+		c.mu.Unlock()
+
+		if pq != nil && isResponseTo(resp, pq.query) {
+			select {
+			case pq.resp <- resp:
+			default:
+			}
+		}
+	}
+}
+
+func (c *tlsConn) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+func (c *tlsConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *tlsConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.isClosed() {
+		close(c.closed)
+		c.conn.Close()
+	}
+}
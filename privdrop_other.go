@@ -0,0 +1,18 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+//dropPrivileges changing user is not supported on this platform
+func dropPrivileges() error {
+	if viper.GetString("user") != "" || viper.GetString("group") != "" || viper.GetString("chroot") != "" {
+		return fmt.Errorf("dropping privileges is not supported on this platform")
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+//dropPrivileges permanently switches to the configured user and group once all
+//listeners have been bound, optionally chrooting first. Does nothing if no user
+//is configured or the process is already running as the user, such as after an
+//upgrade from a process which had already dropped privileges
+func dropPrivileges() error {
+	username := viper.GetString("user")
+	if username == "" {
+		if viper.GetString("group") != "" || viper.GetString("chroot") != "" {
+			return fmt.Errorf("group and chroot require user to be set")
+		}
+		return nil
+	}
+
+	uid, gid, err := lookupUserGroup(username, viper.GetString("group"))
+	if err != nil {
+		return err
+	}
+
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+
+	if dir := viper.GetString("chroot"); dir != "" {
+		//System roots can't be loaded from inside the chroot, so load them now
+		//for blocklist and DoH forwarder HTTPS requests
+		if _, err := x509.SystemCertPool(); err != nil {
+			log.Printf("failed to load system root certificates: %s\n", err)
+		}
+
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("failed to chroot to %s: %s", dir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("failed to chdir in chroot: %s", err)
+		}
+	}
+
+	//Group must be changed first as changing the user drops the permission to do so
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %s", uid, err)
+	}
+
+	//Make sure the drop is permanent
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("able to regain root after dropping privileges")
+	}
+
+	log.Printf("Dropped privileges to %s (uid %d, gid %d)", username, uid, gid)
+
+	return nil
+}
+
+//lookupUserGroup resolves the user and group names or ids, using the user's
+//primary group if no group is given
+func lookupUserGroup(username, group string) (int, int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		if u, err = user.LookupId(username); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %s", username)
+		}
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid %s for user %s", u.Uid, username)
+	}
+
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %s", group)
+			}
+		}
+		gidStr = g.Gid
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid %s", gidStr)
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+
+	//proxyV1MaxLen maximum length of a v1 header including CRLF
+	proxyV1MaxLen = 107
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//proxyListener accepts connections which start with a PROXY protocol v1 or v2
+//header (as sent by HAProxy and others), reporting the client address from the
+//header as the remote address. Headers are only accepted from trusted proxies
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+//newProxyListener wraps the listener, trusting headers from the given CIDRs or IPs
+func newProxyListener(ln net.Listener, trusted []string) (*proxyListener, error) {
+	pl := &proxyListener{Listener: ln}
+
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			if ip := net.ParseIP(t); ip != nil && ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %s", t, err)
+		}
+		pl.trusted = append(pl.trusted, cidr)
+	}
+
+	return pl, nil
+}
+
+//Accept implements net.Listener. The header is read on first use of the
+//connection so a slow proxy doesn't hold up accepting other connections
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !pl.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, cidr := range pl.trusted {
+		if cidr.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//proxyConn a connection from a trusted proxy, which must start with a header
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	//readDeadline last deadline set by the user of the conn, restored after
+	//reading the header
+	dmu          sync.Mutex
+	readDeadline time.Time
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.once.Do(pc.readHeader)
+	if pc.err != nil {
+		return 0, pc.err
+	}
+
+	return pc.r.Read(b)
+}
+
+//RemoteAddr the client address given in the header, or the proxy's address if
+//the header didn't contain one
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.once.Do(pc.readHeader)
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) SetDeadline(t time.Time) error {
+	pc.dmu.Lock()
+	pc.readDeadline = t
+	pc.dmu.Unlock()
+
+	return pc.Conn.SetDeadline(t)
+}
+
+func (pc *proxyConn) SetReadDeadline(t time.Time) error {
+	pc.dmu.Lock()
+	pc.readDeadline = t
+	pc.dmu.Unlock()
+
+	return pc.Conn.SetReadDeadline(t)
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.dmu.Lock()
+	deadline := pc.readDeadline
+	pc.dmu.Unlock()
+
+	headerDeadline := time.Now().Add(proxyHeaderTimeout)
+	if !deadline.IsZero() && deadline.Before(headerDeadline) {
+		headerDeadline = deadline
+	}
+	pc.Conn.SetReadDeadline(headerDeadline)
+
+	pc.remoteAddr, pc.err = readProxyHeader(pc.r)
+	if pc.err != nil {
+		log.Printf("invalid PROXY header from %s: %s\n", pc.Conn.RemoteAddr(), pc.err)
+		pc.Conn.Close()
+	}
+
+	pc.dmu.Lock()
+	pc.Conn.SetReadDeadline(pc.readDeadline)
+	pc.dmu.Unlock()
+}
+
+//readProxyHeader reads a v1 or v2 header returning the source address, which is
+//nil for LOCAL (v2) or UNKNOWN (v1) connections such as health checks
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2Header(r)
+	}
+
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+
+	return nil, fmt.Errorf("missing PROXY header")
+}
+
+//readProxyV1Header parses the human readable header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 853\r\n"
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid v1 source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2Header parses the binary header, ignoring any TLVs
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0x0:
+		//LOCAL
+		return nil, nil
+	case 0x1:
+		//PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0xf)
+	}
+
+	switch fam >> 4 {
+	case 0x1:
+		//AF_INET: src addr, dst addr, src port, dst port
+		if length < 12 {
+			return nil, fmt.Errorf("v2 header too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		//AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("v2 header too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		//AF_UNSPEC or AF_UNIX don't carry a usable client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+//listenPacketReusePort opens n packet conns on the same address so the kernel can
+//spread incoming datagrams across them. SO_REUSEPORT is only set when more than
+//one socket is requested
+func listenPacketReusePort(network, addr string, n int) ([]net.PacketConn, error) {
+	if n <= 1 {
+		conn, err := listenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{conn}, nil
+	}
+
+	lc := &net.ListenConfig{Control: reusePortControl}
+
+	conns := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		key := listenerKey(network, addr)
+		if i > 0 {
+			key = fmt.Sprintf("%s#%d", key, i)
+		}
+
+		conn, err := listenPacketConfig(lc, key, network, addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	return conns, nil
+}
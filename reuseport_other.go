@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+//reusePortControl SO_REUSEPORT is not supported on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,115 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//BenchmarkUDPSockets measures the query throughput of one socket against one
+//SO_REUSEPORT socket per CPU (at least 4), each with its own read loop like the
+//UDP listener
+func BenchmarkUDPSockets(b *testing.B) {
+	sockets := runtime.NumCPU()
+	if sockets < 4 {
+		sockets = 4
+	}
+
+	for _, n := range []int{1, sockets} {
+		b.Run(fmt.Sprintf("sockets=%d", n), func(b *testing.B) {
+			benchmarkUDPSockets(b, n)
+		})
+	}
+}
+
+func benchmarkUDPSockets(b *testing.B, n int) {
+	addr := freeUDPAddr(b)
+
+	conns, err := listenPacketReusePort("udp", addr, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, c := range conns {
+		bc := newBatchPacketConn(c, 32)
+		defer bc.Close()
+
+		go echoDNSResponses(bc)
+	}
+
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	//Many clients, each with its own source port, so the kernel spreads them
+	//across the sockets
+	b.SetParallelism(16)
+	b.ResetTimer()
+	start := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		client, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer client.Close()
+
+		buf := make([]byte, 512)
+		for pb.Next() {
+			client.Write(query)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := client.Read(buf); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "queries/s")
+}
+
+//echoDNSResponses answers each query with itself marked as a response, parsing
+//and packing it as a real query would be
+func echoDNSResponses(conn *batchPacketConn) {
+	for {
+		batch, n, err := conn.ReadBatch()
+		if err != nil {
+			return
+		}
+
+		for _, dgram := range (*batch)[:n] {
+			msg := &dnsmessage.Message{}
+			if err := msg.Unpack(dgram.Buffers[0][:dgram.N]); err != nil {
+				continue
+			}
+			msg.Header.Response = true
+
+			resp, _ := msg.Pack()
+			conn.WriteTo(resp, dgram.Addr)
+		}
+
+		conn.ReleaseBatch(batch)
+	}
+}
+
+//freeUDPAddr a loopback address with a port no socket is bound to
+func freeUDPAddr(b *testing.B) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
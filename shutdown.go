@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	//inflightMu guards inflight and draining, so no query can start once
+	//draining is set while shutdown waits for inflight to reach 0
+	inflightMu sync.Mutex
+	inflightCond = sync.NewCond(&inflightMu)
+
+	//inflight the number of queries currently being handled
+	inflight int
+
+	//draining is set once shutdown has begun and new queries should be ignored
+	draining bool
+
+	//handingOff is set when shutting down after handing listeners to a new process
+	handingOff int32
+
+	shutdownMu sync.Mutex
+
+	//listeners stop accepting new connections as soon as shutdown begins
+	listeners []io.Closer
+
+	//packetConns are closed once in-flight queries have drained, as responses
+	//to queries received on them are still being written until then
+	packetConns []io.Closer
+
+	httpServers []*http.Server
+
+	//tcpConns open DNS over TCP/TLS connections
+	tcpConns sync.Map
+)
+
+//registerListener adds a listener to be closed when shutdown begins
+func registerListener(ln io.Closer) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	listeners = append(listeners, ln)
+}
+
+//registerPacketConn adds a packet conn to be closed after in-flight queries drain
+func registerPacketConn(conn io.Closer) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	packetConns = append(packetConns, conn)
+}
+
+//registerHTTPServer adds a HTTP server to be gracefully shut down
+func registerHTTPServer(srv *http.Server) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	httpServers = append(httpServers, srv)
+}
+
+//startRequest marks a query as in-flight, returning false if the server is
+//shutting down and the query should not be handled
+func startRequest() bool {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	if draining {
+		return false
+	}
+	inflight++
+
+	return true
+}
+
+//finishRequest marks an in-flight query as completed
+func finishRequest() {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	inflight--
+	if inflight == 0 {
+		inflightCond.Broadcast()
+	}
+}
+
+//startDraining stops new queries from being handled
+func startDraining() {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	draining = true
+}
+
+//waitForInflight blocks until all in-flight queries have completed
+func waitForInflight() {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	for inflight > 0 {
+		inflightCond.Wait()
+	}
+}
+
+//waitForShutdown blocks until SIGINT or SIGTERM is received then shuts down. On
+//SIGUSR2 the listeners are handed to a new process before shutting down
+func waitForShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	for sig := range sigs {
+		if sig == syscall.SIGUSR2 {
+			log.Println("Received upgrade signal, handing over listeners...")
+			if err := upgrade(); err != nil {
+				log.Printf("failed to upgrade: %s\n", err)
+				continue
+			}
+			atomic.StoreInt32(&handingOff, 1)
+		}
+
+		log.Printf("Received %s, shutting down...", sig)
+		break
+	}
+
+	shutdown(time.Duration(viper.GetInt("shutdown_timeout")) * time.Second)
+}
+
+//shutdown stops accepting new queries and waits up to the timeout for in-flight
+//queries to complete before closing all sockets and calling plugin shutdown hooks
+func shutdown(timeout time.Duration) {
+	startDraining()
+
+	//After handing off, systemd is already tracking the new process
+	if atomic.LoadInt32(&handingOff) == 0 {
+		sdNotify("STOPPING=1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	//Wake up idle TCP connections blocked on reading their next query
+	tcpConns.Range(func(c interface{}, _ interface{}) bool {
+		c.(net.Conn).SetReadDeadline(time.Now())
+		return true
+	})
+
+	var wg sync.WaitGroup
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("failed to shutdown HTTP server: %s\n", err)
+			}
+		}(srv)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		waitForInflight()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("Drained in-flight requests")
+	case <-ctx.Done():
+		log.Println("Timed out waiting for in-flight requests")
+	}
+
+	wg.Wait()
+
+	for _, conn := range packetConns {
+		conn.Close()
+	}
+
+	plugins.Shutdown()
+
+	log.Println("Shutdown complete")
+}
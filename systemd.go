@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tcfw/minidns/plugins"
+)
+
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	envNotifySocket  = "NOTIFY_SOCKET"
+	envWatchdogUSec  = "WATCHDOG_USEC"
+	envWatchdogPID   = "WATCHDOG_PID"
+)
+
+//activated sockets passed by systemd socket activation keyed by their FileDescriptorName
+var activated = map[string][]*os.File{}
+
+func init() {
+	defer func() {
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenFDNames)
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n <= 0 {
+		return
+	}
+
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		activated[name] = append(activated[name], os.NewFile(uintptr(firstExtraFD+i), name))
+	}
+}
+
+//adoptActivated maps the sockets passed by systemd onto the listeners with the
+//same name, so they are used instead of opening new sockets. Each socket is used
+//for the listener's socket of the same type, so DNSCrypt listeners can be passed
+//both a datagram and a stream socket. For UDP listeners with multiple sockets,
+//each datagram fd with the name is used for the next socket
+func adoptActivated(cfgs []listenerConfig) {
+	if len(activated) == 0 {
+		return
+	}
+
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+
+	for _, cfg := range cfgs {
+		files, ok := activated[cfg.Name]
+		if !ok {
+			continue
+		}
+		delete(activated, cfg.Name)
+
+		count := map[string]int{}
+
+		for _, f := range files {
+			network := socketNetwork(f)
+
+			key := listenerKey(network, cfg.hostPort())
+			if i := count[network]; i > 0 {
+				key = fmt.Sprintf("%s#%d", key, i)
+			}
+			count[network]++
+
+			if prev, ok := inherited[key]; ok {
+				prev.Close()
+			}
+			inherited[key] = f
+		}
+
+		log.Printf("Using %d socket(s) from systemd for listener %s", len(files), cfg)
+	}
+
+	for name, files := range activated {
+		log.Printf("No listener named %s for socket from systemd, closing", name)
+		closeFiles(files)
+		delete(activated, name)
+	}
+}
+
+//socketNetwork the network of the socket, udp for datagram sockets and tcp for
+//stream sockets
+func socketNetwork(f *os.File) string {
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return "tcp"
+	}
+	conn.Close()
+
+	return "udp"
+}
+
+//sdNotify sends the state to the systemd notify socket if running as a systemd
+//notify service
+func sdNotify(state string) error {
+	socket := os.Getenv(envNotifySocket)
+	if socket == "" {
+		return nil
+	}
+
+	//Abstract namespace sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+//notifySystemdReady waits for the plugins to be ready, such as blocklists being
+//loaded, then tells systemd the service has started and begins watchdog pings
+func notifySystemdReady() {
+	if os.Getenv(envNotifySocket) == "" {
+		return
+	}
+
+	go func() {
+		plugins.WaitReady()
+
+		if err := sdNotify("READY=1"); err != nil {
+			log.Printf("failed to notify systemd: %s\n", err)
+			return
+		}
+
+		if interval := watchdogInterval(); interval > 0 {
+			go watchdog(interval)
+		}
+	}()
+}
+
+//watchdogInterval half the configured systemd watchdog timeout, or 0 if the
+//watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv(envWatchdogUSec))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv(envWatchdogPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("failed to send systemd watchdog ping: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	tcpWriteTimeout = 5 * time.Second
+)
+
+//listenForTCPConns accepts DNS over TCP connections (RFC 7766) limiting the number
+//of concurrent connections to tcp_max_conns
+func listenForTCPConns(ln net.Listener, pipeline *plugins.Pipeline) error {
+	return acceptTCPConns(ln, func(c net.Conn) {
+		handleTCPConn(c, pipeline)
+	})
+}
+
+//acceptTCPConns passes each accepted connection to handle, closing connections
+//beyond tcp_max_conns straight away
+func acceptTCPConns(ln net.Listener, handle func(c net.Conn)) error {
+	sem := make(chan struct{}, viper.GetInt("tcp_max_conns"))
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			log.Printf("too many TCP connections on %s, dropping connection\n", ln.Addr())
+			c.Close()
+			continue
+		}
+
+		go func() {
+			handle(c)
+			<-sem
+		}()
+	}
+}
+
+//handleTCPConn reads pipelined queries from a single connection until the client
+//closes it or it has been idle for longer than tcp_idle_timeout. Queries are
+//handled concurrently and responses may be returned out of order
+func handleTCPConn(c net.Conn, pipeline *plugins.Pipeline) {
+	idleTimeout := time.Duration(viper.GetInt("tcp_idle_timeout")) * time.Second
+
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+
+	tcpConns.Store(c, true)
+
+	defer func() {
+		wg.Wait()
+		c.Close()
+		tcpConns.Delete(c)
+	}()
+
+	for {
+		c.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		req, err := plugins.ReadTCPMessage(c)
+		if err != nil {
+			if err != io.EOF && shouldLogVerbose() {
+				log.Printf("closing TCP connection from %s: %s\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+
+		//Only queries are accepted over TCP
+		if req.Header.Response {
+			continue
+		}
+
+		if !startRequest() {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer finishRequest()
+
+			bytes := handleRequest(pipeline, nil, c.RemoteAddr(), req)
+
+			wmu.Lock()
+			defer wmu.Unlock()
+
+			c.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if err := plugins.WriteTCPMessage(c, bytes); err != nil {
+				log.Printf("failed to write TCP response: %s\n", err)
+			}
+		}()
+	}
+}
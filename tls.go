@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	certCheckInterval = 10 * time.Second
+)
+
+//tlsEnabled checks if a certificate and key have been configured for the TLS based listeners
+func tlsEnabled() bool {
+	return viper.GetString("tls_cert") != "" && viper.GetString("tls_key") != ""
+}
+
+//certReloader serves a TLS certificate from disk, reloading it when either the
+//certificate or key file has changed since it was last loaded
+type certReloader struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+//GetCertificate implements tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	cert := cr.cert
+	shouldCheck := time.Since(cr.lastCheck) > certCheckInterval
+	cr.mu.RUnlock()
+
+	if shouldCheck {
+		if err := cr.reload(); err != nil {
+			log.Printf("failed to reload TLS certificate, using previous: %s\n", err)
+		} else {
+			cr.mu.RLock()
+			cert = cr.cert
+			cr.mu.RUnlock()
+		}
+	}
+
+	return cert, nil
+}
+
+//reload loads the key pair if the files have been modified since the last load
+func (cr *certReloader) reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.lastCheck = time.Now()
+
+	//The first load after an upgrade may use files passed from the previous
+	//process, which can't always be checked as the user
+	modTime, err := cr.latestModTime()
+	if err != nil && cr.cert != nil {
+		return err
+	}
+
+	if cr.cert != nil && !modTime.After(cr.modTime) {
+		return nil
+	}
+
+	certPEM, err := readKeyFile(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := readKeyFile(cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	if cr.cert != nil {
+		log.Printf("Reloaded TLS certificate %s", cr.certFile)
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+
+	return nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+//tlsConfig builds a server TLS config using the reloader for certificates
+func (cr *certReloader) tlsConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+		NextProtos:     nextProtos,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/tcfw/minidns/plugins"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//udpResponseLimit the maximum size of a UDP response to the query, being the
+//smaller of the client's and our own advertised EDNS(0) payload sizes
+func udpResponseLimit(req *dnsmessage.Message) int {
+	edns := plugins.ParseEDNS(req)
+	if edns == nil {
+		return plugins.MinUDPSize
+	}
+
+	limit := plugins.ClientUDPSize(edns)
+	if server := int(plugins.ServerUDPSize()); server < limit {
+		limit = server
+	}
+
+	return limit
+}
+
+//truncate packs the response with the TC bit set, keeping as many whole answer
+//RRsets as fit within the size limit so the client knows to retry over TCP
+func truncate(resp *dnsmessage.Message, limit int) ([]byte, error) {
+	answers := resp.Answers
+
+	resp.Header.Truncated = true
+	resp.Authorities = nil
+
+	additionals := []dnsmessage.Resource{}
+	for _, rr := range resp.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	resp.Additionals = additionals
+
+	for n := len(answers); n >= 0; n-- {
+		resp.Answers = answers[:wholeRRSets(answers, n)]
+
+		bytes, err := resp.Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bytes) <= limit {
+			return bytes, nil
+		}
+	}
+
+	//Nothing else can be removed
+	return resp.Pack()
+}
+
+//wholeRRSets shortens n so the first n records don't split an RRset
+func wholeRRSets(rrs []dnsmessage.Resource, n int) int {
+	for n > 0 && n < len(rrs) && sameRRSet(rrs[n-1].Header, rrs[n].Header) {
+		n--
+	}
+
+	return n
+}
+
+func sameRRSet(a, b dnsmessage.ResourceHeader) bool {
+	return a.Name == b.Name && a.Type == b.Type && a.Class == b.Class
+}
+
+//truncatedHeader packs a response with only the header and the TC bit set, for
+//when the response can't be truncated, so the client still retries over TCP
+func truncatedHeader(resp *dnsmessage.Message) []byte {
+	header := resp.Header
+	header.Response = true
+	header.Truncated = true
+
+	bytes, _ := (&dnsmessage.Message{Header: header}).Pack()
+
+	return bytes
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	envUpgradeFDs     = "MINIDNS_UPGRADE_FDS"
+	envUpgradeReadyFD = "MINIDNS_UPGRADE_READY_FD"
+
+	//first file descriptor passed via exec.Cmd.ExtraFiles
+	firstExtraFD = 3
+)
+
+//filer is implemented by the net listeners and conns which can be handed over
+type filer interface {
+	File() (*os.File, error)
+}
+
+type handoff struct {
+	key  string
+	conn filer
+}
+
+var (
+	handoffMu sync.Mutex
+
+	//handoffs are all listening sockets, passed to the new process on upgrade
+	handoffs []handoff
+
+	//inherited sockets passed from the previous process keyed by network/address
+	inherited = map[string]*os.File{}
+
+	//executable is resolved at startup, as /proc may not be readable after
+	//dropping privileges
+	executable, executableErr = os.Executable()
+)
+
+func init() {
+	names := os.Getenv(envUpgradeFDs)
+	if names == "" {
+		return
+	}
+
+	for i, key := range strings.Split(names, ",") {
+		inherited[key] = os.NewFile(uintptr(firstExtraFD+i), key)
+	}
+
+	os.Unsetenv(envUpgradeFDs)
+}
+
+//isUpgrade checks if this process was started by a running process handing over its listeners
+func isUpgrade() bool {
+	return os.Getenv(envUpgradeReadyFD) != ""
+}
+
+//listenPacket opens a packet conn on the address, adopting the socket passed from
+//the previous process if there was one
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	return listenPacketConfig(&net.ListenConfig{}, listenerKey(network, addr), network, addr)
+}
+
+//listenPacketConfig opens a packet conn using the listen config, or adopts the
+//inherited socket with the given key
+func listenPacketConfig(lc *net.ListenConfig, key string, network, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+
+	if f := takeInherited(key); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = lc.ListenPacket(context.Background(), network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := conn.(filer); ok {
+		addHandoff(key, f)
+	}
+
+	return conn, nil
+}
+
+//listen opens a stream listener on the address, adopting the socket passed from
+//the previous process if there was one
+func listen(network, addr string) (net.Listener, error) {
+	key := listenerKey(network, addr)
+
+	var ln net.Listener
+	var err error
+
+	if f := takeInherited(key); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := ln.(filer); ok {
+		addHandoff(key, f)
+	}
+
+	return ln, nil
+}
+
+func listenerKey(network, addr string) string {
+	return network + "/" + addr
+}
+
+func takeInherited(key string) *os.File {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+
+	f, ok := inherited[key]
+	if !ok {
+		return nil
+	}
+	delete(inherited, key)
+
+	return f
+}
+
+func addHandoff(key string, conn filer) {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+
+	handoffs = append(handoffs, handoff{key: key, conn: conn})
+}
+
+//closeUnusedInherited closes sockets from the previous process which no longer
+//match a configured listener
+func closeUnusedInherited() {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+
+	for key, f := range inherited {
+		log.Printf("Closing unused inherited listener %s", key)
+		f.Close()
+		delete(inherited, key)
+	}
+}
+
+//notifyUpgradeReady tells the previous process that this process has taken over
+//its listeners, so it can drain and exit
+func notifyUpgradeReady() {
+	fdStr := os.Getenv(envUpgradeReadyFD)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(envUpgradeReadyFD)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.Printf("invalid upgrade ready fd: %s\n", err)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("failed to notify previous process: %s\n", err)
+		return
+	}
+
+	log.Println("Took over listeners from previous process")
+}
+
+//upgrade starts a new instance of the binary, handing over all listening sockets
+//and waiting for it to report it is ready to serve
+func upgrade() error {
+	//The binary and config can't be reached from inside the chroot
+	if viper.GetString("chroot") != "" {
+		return fmt.Errorf("upgrading is not supported with chroot set, restart instead")
+	}
+
+	if executableErr != nil {
+		return executableErr
+	}
+
+	handoffMu.Lock()
+	keys := make([]string, 0, len(handoffs))
+	files := make([]*os.File, 0, len(handoffs)+1)
+	for _, h := range handoffs {
+		f, err := h.conn.File()
+		if err != nil {
+			handoffMu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("failed to get file for %s: %s", h.key, err)
+		}
+		keys = append(keys, h.key)
+		files = append(files, f)
+	}
+	handoffMu.Unlock()
+	defer closeFiles(files)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	keysR, keysW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	defer keysR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW, keysR)
+	cmd.Env = append(upgradeEnviron(),
+		fmt.Sprintf("%s=%s", envUpgradeFDs, strings.Join(keys, ",")),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFD, firstExtraFD+len(files)),
+		fmt.Sprintf("%s=%d", envUpgradeKeysFD, firstExtraFD+len(files)+1),
+	)
+
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		keysW.Close()
+		return err
+	}
+	readyW.Close()
+
+	//The new process may not be able to read the key files as the user
+	go writeKeyFiles(keysW)
+
+	log.Printf("Started new process %d, waiting for it to be ready...", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		//Read returns EOF if the new process exits without reporting ready
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	go cmd.Wait()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("new process exited before becoming ready: %s", err)
+		}
+	case <-time.After(time.Duration(viper.GetInt("upgrade_timeout")) * time.Second):
+		cmd.Process.Kill()
+		return fmt.Errorf("timed out waiting for new process to become ready")
+	}
+
+	//Let systemd track the new process as the main process of the service
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Printf("failed to notify systemd of new main process: %s\n", err)
+	}
+
+	return nil
+}
+
+//upgradeEnviron the current environment without any previous upgrade variables.
+//The systemd watchdog pid is dropped so the new process sends watchdog pings
+func upgradeEnviron() []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, envUpgradeFDs+"=") || strings.HasPrefix(e, envUpgradeReadyFD+"=") || strings.HasPrefix(e, envUpgradeKeysFD+"=") || strings.HasPrefix(e, envWatchdogPID+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+
+	return env
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
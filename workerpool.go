@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/tcfw/minidns/metrics"
+	"github.com/tcfw/minidns/plugins"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//Overload policies for when the UDP worker queue is full
+const (
+	overloadDrop     = "drop"
+	overloadRefused  = "refused"
+	overloadServFail = "servfail"
+)
+
+type udpJob struct {
+	pipeline *plugins.Pipeline
+	conn     net.PacketConn
+	addr     net.Addr
+	req      *dnsmessage.Message
+
+	//dnscrypt is set for DNSCrypt queries, which are decrypted from packet by
+	//the worker rather than parsed into req
+	dnscrypt *dnscryptServer
+	packet   []byte
+
+	//tracked if the query was marked as in-flight, which queries read while
+	//handing off to a new process are not
+	tracked bool
+}
+
+//handle runs the query through the pipeline and writes the response
+func (job udpJob) handle() {
+	if job.dnscrypt != nil {
+		if resp := job.dnscrypt.handle(job.pipeline, job.addr, job.packet, true); resp != nil {
+			job.conn.WriteTo(resp, job.addr)
+		}
+		return
+	}
+
+	handleUDPRequest(job.pipeline, job.conn, job.addr, job.req)
+}
+
+//reject responds to the query with the rcode without running the plugin chain
+func (job udpJob) reject(rcode dnsmessage.RCode) {
+	var bytes []byte
+	if job.dnscrypt != nil {
+		bytes = job.dnscrypt.reject(job.addr, job.packet, rcode)
+	} else {
+		bytes = rejectResponse(job.req, rcode)
+	}
+
+	if bytes != nil {
+		job.conn.WriteTo(bytes, job.addr)
+	}
+}
+
+//done marks the query as completed if it was in-flight
+func (job udpJob) done() {
+	if job.tracked {
+		finishRequest()
+	}
+}
+
+//workerPool handles UDP and DNSCrypt over UDP queries with a fixed number of workers fed from a
+//bounded queue, shedding queries once the queue is full
+type workerPool struct {
+	jobs   chan udpJob
+	policy string
+}
+
+func newWorkerPool(workers int, queueSize int, policy string) *workerPool {
+	switch policy {
+	case overloadDrop, overloadRefused, overloadServFail:
+	default:
+		log.Printf("unknown overload policy %q, using %q", policy, overloadDrop)
+		policy = overloadDrop
+	}
+
+	wp := &workerPool{
+		jobs:   make(chan udpJob, queueSize),
+		policy: policy,
+	}
+
+	for i := 0; i < workers; i++ {
+		go wp.work()
+	}
+
+	return wp
+}
+
+func (wp *workerPool) work() {
+	for job := range wp.jobs {
+		metrics.AddQueueDepth(-1)
+		job.handle()
+		job.done()
+	}
+}
+
+//submit queues the query for a worker, applying the overload policy if the
+//queue is full
+func (wp *workerPool) submit(job udpJob) {
+	//The depth is counted before queueing, as a worker may take the job and
+	//decrement it straight away
+	metrics.AddQueueDepth(1)
+
+	select {
+	case wp.jobs <- job:
+		return
+	default:
+	}
+
+	metrics.AddQueueDepth(-1)
+
+	defer job.done()
+
+	metrics.IncShed(wp.policy)
+
+	switch wp.policy {
+	case overloadRefused:
+		job.reject(dnsmessage.RCodeRefused)
+	case overloadServFail:
+		job.reject(dnsmessage.RCodeServerFailure)
+	}
+}
+
+//rejectResponse packs a response to the query with the rcode and no records
+func rejectResponse(req *dnsmessage.Message, rcode dnsmessage.RCode) []byte {
+	edns := plugins.ParseEDNS(req)
+
+	req.Header.Response = true
+	req.Header.RCode = rcode
+	req.Answers = nil
+	req.Authorities = nil
+	req.Additionals = nil
+	plugins.SetResponseEDNS(req, edns)
+
+	bytes, err := req.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return bytes
+}
+
+//newUDPWorkerPool creates the worker pool from the config
+func newUDPWorkerPool() *workerPool {
+	return newWorkerPool(
+		viper.GetInt("udp_workers"),
+		viper.GetInt("udp_queue_size"),
+		viper.GetString("overload_policy"),
+	)
+}